@@ -7,6 +7,8 @@ import (
 type Token struct {
 	Type  uint8
 	Coord FileCoord
+	// Whether the token was written in double quotes
+	Quoted bool
 }
 
 func (t Token) Text() string {
@@ -50,8 +52,9 @@ func lexLine(coord FileCoord) ([]Token, error) {
 			}
 
 			toks = append(toks, Token{
-				Type:  t,
-				Coord: coord,
+				Type:   t,
+				Coord:  coord,
+				Quoted: force,
 			})
 			bStart = -1
 		}
@@ -0,0 +1,40 @@
+package aptfile
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Check parsed directives for things that are allowed but likely to be
+// mistakes or security risks, returning a message for each problem found.
+func Lint(dirs []any) []string {
+	warnings := make([]string, 0)
+	aptConfKeys := make(map[string]bool)
+	for _, d := range dirs {
+		switch dir := d.(type) {
+		case AptConfDirective:
+			if aptConfKeys[dir.Key] && !strings.HasSuffix(dir.Key, "::") {
+				warnings = append(warnings, fmt.Sprintf(`aptconf %s is set more than once, so only the last value is used`, dir.Key))
+			}
+			aptConfKeys[dir.Key] = true
+		case RepoDirective:
+			if u, err := url.Parse(dir.URL); err == nil && u.User != nil {
+				warnings = append(warnings, fmt.Sprintf(`repo for %s has credentials in its URL, which end up in sources.list.d; use auth instead`, u.Redacted()))
+			}
+		case DebconfDirective:
+			if dir.Type == "password" && !dir.IsSecret {
+				warnings = append(warnings, fmt.Sprintf(`debconf password %s is not marked secret: "true", so it will be shown in output`, dir.Question))
+			}
+		case DebFileDirective:
+			if isRemote(dir.Path) && dir.SHA256 == "" && dir.SHA512 == "" {
+				warnings = append(warnings, fmt.Sprintf(`deb "%s" is downloaded without a sha256 or sha512 checksum`, dir.Path))
+			}
+		}
+	}
+	return warnings
+}
+
+func isRemote(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -22,28 +24,51 @@ type PackageDirective struct {
 }
 
 type PinDirective struct {
-	Priority    int32
+	Priority int32
+	// Space-separated package names, globs like "nvidia-*", or regular
+	// expressions between slashes like "/^cuda-[0-9-]+$/"
 	PackageName string
 	// A specific version or pattern
 	Version string
 
-	// A specific origin or pattern. "" is localhost
+	// A specific origin or pattern. `""` is localhost
 	// like origin *ubuntu.com*
 	Origin string
 
 	// Release specifiers
 	// These look like "a=Debian l=Nvidia"
 	Release string
+
+	// From the comment lines just above the pin, one line per line
+	Explanation string
 }
 
 type PpaDirective struct {
 	Name string
+	// Distribution series to use instead of the system's, e.g. "jammy"
+	Series string
+	// Also add the deb-src line
+	IsSrc bool
+	// Credentials for a private PPA, see AUTH_ENV_PREFIX and AUTH_FILE_PREFIX
+	Auth string
+	// Expected fingerprint of the signing key, for private PPAs whose
+	// details Launchpad won't show
+	Fingerprint string
 }
 
 type RepoDirective struct {
-	IsSrc     bool
-	Arch      string
-	SignedBy  string
+	IsSrc bool
+	Arch  string
+	// Where to get the signing key. One of a URL, an HKP keyserver URL
+	// like "hkps://keyserver.ubuntu.com/0xFINGERPRINT", or a Web Key
+	// Directory lookup like "wkd:security@example.com"
+	SignedBy string
+	// Expected fingerprint of the signing key. Required with Keyserver.
+	Fingerprint string
+	// HKP keyserver to fetch Fingerprint from, e.g. "hkps://keyserver.ubuntu.com"
+	Keyserver string
+	// Credentials for the repo, see AUTH_ENV_PREFIX and AUTH_FILE_PREFIX
+	Auth      string
 	Suite     string
 	Component string
 	URL       string
@@ -51,29 +76,129 @@ type RepoDirective struct {
 
 type DebFileDirective struct {
 	Path string
+	// Expected hex digests of the file, checked before installing
+	SHA256 string
+	SHA512 string
 }
 
 type HoldDirective struct {
 	PackageName string
+	// Install this version before holding, rather than holding whatever
+	// is installed
+	Version string
+}
+
+type UnholdDirective struct {
+	PackageName string
+}
+
+// An answer to a debconf question, set before packages are installed so
+// that they don't fall back to defaults
+type DebconfDirective struct {
+	Package  string
+	Question string
+	// A debconf type like "string", "boolean" or "select"
+	Type  string
+	Value string
+	// Don't show Value in output
+	IsSecret bool
+}
+
+// An apt configuration setting, like `aptconf "Acquire::Retries" "3"`. A
+// key ending in "::" adds to a list, like Dpkg::Options.
+type AptConfDirective struct {
+	Key   string
+	Value string
+}
+
+// The question types debconf-set-selections accepts
+var debconfTypes = []string{"string", "password", "boolean", "select", "multiselect", "note", "text", "title", "error"}
+
+// Settings for adapt itself, like `config "proxy" "http://proxy:3128"`
+type ConfigDirective struct {
+	Key   string
+	Value string
 }
 
+const (
+	CONFIG_PROXY         = "proxy"
+	CONFIG_CA_FILE       = "ca-file"
+	CONFIG_CONFIGURE_APT = "configure-apt"
+)
+
+// Credentials for private repos are given by reference, never inline:
+// "env:NAME" reads them from an environment variable and "file:PATH" from
+// a file. Either way they look like "login:password".
+const (
+	AUTH_ENV_PREFIX  = "env:"
+	AUTH_FILE_PREFIX = "file:"
+)
+
+const HEREDOC_PREFIX = "<<"
+
 var (
-	ErrNoDirective = errors.New("no directive found")
-	ErrParsing     = errors.New("error parsing aptfile")
+	fingerprintRegex = regexp.MustCompile(`^(0X)?([0-9A-F]{40}|[0-9A-F]{64})$`)
+	sha256Regex      = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	aptConfKeyRegex  = regexp.MustCompile(`^[A-Za-z0-9_.+-]+(::[A-Za-z0-9_.+/-]+)*(::)?$`)
+	sha512Regex      = regexp.MustCompile(`^[0-9a-f]{128}$`)
+	ErrNoDirective   = errors.New("no directive found")
+	ErrParsing       = errors.New("error parsing aptfile")
 )
 
+// Parse an Aptfile. Besides one directive per line, an option value may
+// be given as a heredoc spanning the following lines, e.g. for an inline key:
+//
+//	repo "https://example.com/debian" "stable" "main", signed-by: <<KEY
+//	-----BEGIN PGP PUBLIC KEY BLOCK-----
+//	...
+//	-----END PGP PUBLIC KEY BLOCK-----
+//	KEY
 func Parse(r io.Reader) ([]any, error) {
 	s := bufio.NewScanner(r)
 	result := make([]any, 0)
 	lineNum := 0
+	// The comment lines since the last blank line or directive
+	comments := make([]string, 0)
 	for s.Scan() {
-		dir, err := ParseLine(lineNum, s.Text())
+		line := s.Text()
+		startLineNum := lineNum
 		lineNum += 1
+		if trimmed := strings.TrimSpace(line); strings.HasPrefix(trimmed, "#") {
+			comments = append(comments, strings.TrimSpace(strings.TrimPrefix(trimmed, "#")))
+			continue
+		}
+		var heredoc *string
+		if marker, ok := heredocMarker(startLineNum, line); ok {
+			body, terminated := make([]string, 0), false
+			for s.Scan() {
+				lineNum += 1
+				if strings.TrimSpace(s.Text()) == marker {
+					terminated = true
+					break
+				}
+				body = append(body, s.Text())
+			}
+			if !terminated {
+				return []any{}, ParseError{
+					Message: fmt.Sprintf(`heredoc not terminated by "%s"`, marker),
+					Coord:   FileCoord{Line: line, LineNum: startLineNum, ColStart: 0, ColEnd: len(line)},
+				}
+			}
+			text := strings.Join(body, "\n") + "\n"
+			heredoc = &text
+		}
+		dir, err := parseLine(startLineNum, line, heredoc)
 		if err == ErrNoDirective {
+			comments = comments[:0]
 			continue
 		} else if err != nil {
 			return []any{}, err
 		}
+		if pin, ok := dir.(PinDirective); ok {
+			pin.Explanation = strings.TrimSpace(strings.Join(comments, "\n"))
+			dir = pin
+		}
+		comments = comments[:0]
 		result = append(result, dir)
 	}
 	if err := s.Err(); err != nil {
@@ -82,8 +207,27 @@ func Parse(r io.Reader) ([]any, error) {
 	return result, nil
 }
 
+// If the line ends with an unquoted heredoc start like `<<EOF`,
+// return the terminating marker, e.g. "EOF".
+func heredocMarker(lineNum int, line string) (string, bool) {
+	toks, err := lexLine(FileCoord{Line: line, LineNum: lineNum})
+	if err != nil || len(toks) == 0 {
+		return "", false
+	}
+	last := toks[len(toks)-1]
+	if last.Quoted || last.Type != StringToken {
+		return "", false
+	}
+	marker, ok := strings.CutPrefix(last.Text(), HEREDOC_PREFIX)
+	return marker, ok && marker != ""
+}
+
 // Parse a generic directive of the form `command arg1 arg2 "arg3", key1: "val1", key2: "val2"`
 func ParseLine(lineNum int, line string) (any, error) {
+	return parseLine(lineNum, line, nil)
+}
+
+func parseLine(lineNum int, line string, heredoc *string) (any, error) {
 	toks, err := lexLine(FileCoord{Line: line, LineNum: lineNum})
 	if err != nil {
 		return nil, err
@@ -119,7 +263,12 @@ func ParseLine(lineNum int, line string) (any, error) {
 				toks[curr+1].Type == StringToken &&
 				toks[curr+2].Type == ColonToken &&
 				toks[curr+3].Type == StringToken {
-				opts[toks[curr+1].Text()] = toks[curr+3].Text()
+				value := toks[curr+3].Text()
+				if heredoc != nil && curr+3 == len(toks)-1 {
+					value = *heredoc
+					heredoc = nil
+				}
+				opts[toks[curr+1].Text()] = value
 				curr += 4
 			} else {
 				return DirectiveLine{}, ParseError{
@@ -145,6 +294,12 @@ func ParseLine(lineNum int, line string) (any, error) {
 			curr += 1
 		}
 	}
+	if heredoc != nil {
+		return DirectiveLine{}, ParseError{
+			Message: "heredoc can only be used as an option value",
+			Coord:   toks[len(toks)-1].Coord,
+		}
+	}
 	switch cmd {
 	case "repo", "repo-src":
 		return parseRepoDirective(cmd, args, opts)
@@ -158,6 +313,14 @@ func ParseLine(lineNum int, line string) (any, error) {
 		return parsePinDirective(cmd, args, opts)
 	case "hold":
 		return parseHoldDirective(cmd, args, opts)
+	case "unhold":
+		return parseUnholdDirective(cmd, args, opts)
+	case "config":
+		return parseConfigDirective(cmd, args, opts)
+	case "debconf":
+		return parseDebconfDirective(cmd, args, opts)
+	case "aptconf":
+		return parseAptConfDirective(cmd, args, opts)
 	default:
 		return nil, fmt.Errorf(`unexpected directive "%s"`, cmd)
 	}
@@ -202,6 +365,7 @@ func parsePackageDirective(_ string, args []string, opts map[string]string) (Pac
 }
 
 // pin directives are formatted like, `pin "package1" 333, version: "1.2.3"`
+// or for several packages, `pin "nvidia-* /^cuda-[0-9-]+$/" 600, origin: "developer.download.nvidia.com"`
 func parsePinDirective(_ string, args []string, opts map[string]string) (PinDirective, error) {
 	if len(args) != 2 {
 		return PinDirective{}, errors.New("expected two positional arguments")
@@ -210,42 +374,115 @@ func parsePinDirective(_ string, args []string, opts map[string]string) (PinDire
 	if err != nil {
 		return PinDirective{}, err
 	}
+	patterns := strings.Fields(args[0])
+	if len(patterns) == 0 {
+		return PinDirective{}, errors.New("expected at least one package")
+	}
+	for _, p := range patterns {
+		if len(p) >= 2 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+			if _, err := regexp.Compile(p[1 : len(p)-1]); err != nil {
+				return PinDirective{}, fmt.Errorf(`invalid package regular expression "%s": %w`, p, err)
+			}
+		}
+	}
 	dir := PinDirective{
-		PackageName: args[0],
+		PackageName: strings.Join(patterns, " "),
 		Priority:    int32(pri),
 	}
 	for k, v := range opts {
 		switch k {
 		case "version":
 			dir.Version = v
-			return dir, nil
 		case "origin":
 			dir.Origin = v
-			return dir, nil
+			if v == "" {
+				// The local system, which apt writes as an empty quoted string
+				dir.Origin = `""`
+			}
 		case "release":
 			dir.Release = v
-			return dir, nil
 		default:
 			return PinDirective{}, fmt.Errorf("unknown pin option %s", k)
 		}
 	}
+	if dir.Version == "" && dir.Origin == "" && dir.Release == "" {
+		return PinDirective{}, errors.New(`expected one of "version", "origin" or "release"`)
+	}
+	// apt takes a single Pin: line per stanza, so there's no way to require
+	// a version and a release at once; several fields of a release can be
+	// given together, though, like release: "o=Ubuntu,a=noble"
+	set := 0
+	for _, v := range []string{dir.Version, dir.Origin, dir.Release} {
+		if v != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return PinDirective{}, errors.New(`only one of "version", "origin" or "release" can be given`)
+	}
 	return dir, nil
 }
 
 // ppa directives are formatted like, `ppa "fish-shell/fish-3"`
+// or for a private PPA, `ppa "owner/name", auth: "env:PPA_CREDENTIALS", fingerprint: "ABCD..."`
 func parsePpaDirective(_ string, args []string, opts map[string]string) (PpaDirective, error) {
 	if len(args) != 1 {
 		return PpaDirective{}, fmt.Errorf("expected one argument, got %v", args)
 	}
-	if len(opts) > 0 {
-		return PpaDirective{}, fmt.Errorf("unexpected options %v", opts)
+	dir := PpaDirective{Name: args[0]}
+	for k, v := range opts {
+		switch k {
+		case "series":
+			dir.Series = v
+		case "src":
+			isSrc, err := strconv.ParseBool(v)
+			if err != nil {
+				return PpaDirective{}, fmt.Errorf(`expected "true" or "false" for src, got "%s"`, v)
+			}
+			dir.IsSrc = isSrc
+		case "auth":
+			if err := validateAuth(v); err != nil {
+				return PpaDirective{}, err
+			}
+			dir.Auth = v
+		case "fingerprint":
+			fpr, err := parseFingerprint(v)
+			if err != nil {
+				return PpaDirective{}, err
+			}
+			dir.Fingerprint = fpr
+		default:
+			return PpaDirective{}, fmt.Errorf(`unexpected option "%s"`, k)
+		}
 	}
-	return PpaDirective{
-		Name: args[0],
-	}, nil
+	// Launchpad won't say which key signs a private PPA
+	if dir.Auth != "" && dir.Fingerprint == "" {
+		return PpaDirective{}, errors.New(`"auth" requires "fingerprint"`)
+	}
+	return dir, nil
+}
+
+// Normalize a fingerprint to uppercase hex without spaces or 0x
+func parseFingerprint(v string) (string, error) {
+	fpr := strings.ToUpper(strings.ReplaceAll(v, " ", ""))
+	if !fingerprintRegex.MatchString(fpr) {
+		return "", fmt.Errorf(`invalid fingerprint "%s"`, v)
+	}
+	return strings.TrimPrefix(fpr, "0X"), nil
+}
+
+func validateAuth(v string) error {
+	for _, prefix := range []string{AUTH_ENV_PREFIX, AUTH_FILE_PREFIX} {
+		if strings.HasPrefix(v, prefix) && len(v) > len(prefix) {
+			return nil
+		}
+	}
+	return fmt.Errorf(`expected auth like "%sNAME" or "%sPATH", got "%s"`, AUTH_ENV_PREFIX, AUTH_FILE_PREFIX, v)
 }
 
 // repo directives are formatted like, `repo "http://repo/url" "suite" "component", arch: "amd64", signed-by: "https://url/to/key.gpg`
+// with credentials for a private repo given like `auth: "file:/etc/adapt/artifactory"`
+// or with a keyserver, `repo "http://repo/url" "suite" "component", keyserver: "hkps://keyserver.ubuntu.com", fingerprint: "ABCD..."`
 func parseRepoDirective(cmd string, args []string, opts map[string]string) (RepoDirective, error) {
 	if len(args) == 0 {
 		return RepoDirective{}, errors.New("expected at least one argument")
@@ -266,33 +503,167 @@ func parseRepoDirective(cmd string, args []string, opts map[string]string) (Repo
 			dir.Arch = v
 		case "signed-by":
 			dir.SignedBy = v
+		case "fingerprint":
+			fpr, err := parseFingerprint(v)
+			if err != nil {
+				return RepoDirective{}, err
+			}
+			dir.Fingerprint = fpr
+		case "keyserver":
+			dir.Keyserver = v
+		case "auth":
+			if err := validateAuth(v); err != nil {
+				return RepoDirective{}, err
+			}
+			dir.Auth = v
 		default:
 			return RepoDirective{}, fmt.Errorf(`unexpected option "%s"`, k)
 		}
 	}
+	if dir.Keyserver != "" {
+		if dir.SignedBy != "" {
+			return RepoDirective{}, errors.New(`"keyserver" and "signed-by" cannot both be set`)
+		}
+		if dir.Fingerprint == "" {
+			return RepoDirective{}, errors.New(`"keyserver" requires "fingerprint"`)
+		}
+	} else if dir.Fingerprint != "" && dir.SignedBy == "" {
+		return RepoDirective{}, errors.New(`"fingerprint" requires "signed-by" or "keyserver"`)
+	}
 	return dir, nil
 }
 
-// deb file directives are formatted like, `deb "http://url/to/file.deb"`
+// deb file directives are formatted like, `deb "http://url/to/file.deb", sha256: "abc123..."`
 func parseDebFileDirective(_ string, args []string, opts map[string]string) (DebFileDirective, error) {
 	if len(args) != 1 {
 		return DebFileDirective{}, fmt.Errorf("expected one argument, got %v", args)
 	}
-	if len(opts) > 0 {
-		return DebFileDirective{}, fmt.Errorf("unexpected options %v", opts)
+	dir := DebFileDirective{Path: args[0]}
+	for k, v := range opts {
+		digest := strings.ToLower(v)
+		switch k {
+		case "sha256":
+			if !sha256Regex.MatchString(digest) {
+				return DebFileDirective{}, fmt.Errorf(`invalid sha256 digest "%s"`, v)
+			}
+			dir.SHA256 = digest
+		case "sha512":
+			if !sha512Regex.MatchString(digest) {
+				return DebFileDirective{}, fmt.Errorf(`invalid sha512 digest "%s"`, v)
+			}
+			dir.SHA512 = digest
+		default:
+			return DebFileDirective{}, fmt.Errorf(`unexpected option "%s"`, k)
+		}
 	}
-	return DebFileDirective{Path: args[0]}, nil
+	return dir, nil
 }
 
-// hold directives are formatted like, `hold "curl"`
+// hold directives are formatted like, `hold "curl"` or `hold "curl", version: "8.5.0-2ubuntu10"`
 func parseHoldDirective(_ string, args []string, opts map[string]string) (HoldDirective, error) {
 	if len(args) != 1 {
 		return HoldDirective{}, fmt.Errorf("expected one argument, got %v", args)
 	}
+	dir := HoldDirective{PackageName: args[0]}
+	for k, v := range opts {
+		switch k {
+		case "version":
+			if v == "" {
+				return HoldDirective{}, errors.New("version cannot be empty")
+			}
+			dir.Version = v
+		default:
+			return HoldDirective{}, fmt.Errorf(`unexpected option "%s"`, k)
+		}
+	}
+	return dir, nil
+}
+
+// unhold directives are formatted like, `unhold "curl"`
+func parseUnholdDirective(_ string, args []string, opts map[string]string) (UnholdDirective, error) {
+	if len(args) != 1 {
+		return UnholdDirective{}, fmt.Errorf("expected one argument, got %v", args)
+	}
 	if len(opts) > 0 {
-		return HoldDirective{}, fmt.Errorf("unexpected options %v", opts)
+		return UnholdDirective{}, fmt.Errorf("unexpected options %v", opts)
 	}
-	return HoldDirective{
+	return UnholdDirective{
 		PackageName: args[0],
 	}, nil
 }
+
+// config directives are formatted like, `config "proxy" "http://proxy.internal:3128"`
+func parseConfigDirective(_ string, args []string, opts map[string]string) (ConfigDirective, error) {
+	if len(args) != 2 {
+		return ConfigDirective{}, fmt.Errorf("expected two arguments, got %v", args)
+	}
+	if len(opts) > 0 {
+		return ConfigDirective{}, fmt.Errorf("unexpected options %v", opts)
+	}
+	dir := ConfigDirective{Key: args[0], Value: args[1]}
+	switch dir.Key {
+	case CONFIG_PROXY, CONFIG_CA_FILE:
+	case CONFIG_CONFIGURE_APT:
+		if _, err := strconv.ParseBool(dir.Value); err != nil {
+			return ConfigDirective{}, fmt.Errorf(`expected "true" or "false" for %s, got "%s"`, dir.Key, dir.Value)
+		}
+	default:
+		return ConfigDirective{}, fmt.Errorf(`unknown config key "%s"`, dir.Key)
+	}
+	return dir, nil
+}
+
+// debconf directives are formatted like, `debconf "tzdata" "tzdata/Areas" "select" "Etc"`
+// with `secret: "true"` to keep the value out of output
+func parseDebconfDirective(_ string, args []string, opts map[string]string) (DebconfDirective, error) {
+	if len(args) != 4 {
+		return DebconfDirective{}, fmt.Errorf("expected four arguments, got %d", len(args))
+	}
+	dir := DebconfDirective{Package: args[0], Question: args[1], Type: args[2], Value: args[3]}
+	for k, v := range opts {
+		switch k {
+		case "secret":
+			isSecret, err := strconv.ParseBool(v)
+			if err != nil {
+				return DebconfDirective{}, fmt.Errorf(`expected "true" or "false" for secret, got "%s"`, v)
+			}
+			dir.IsSecret = isSecret
+		default:
+			return DebconfDirective{}, fmt.Errorf(`unexpected option "%s"`, k)
+		}
+	}
+	// debconf-set-selections reads one whitespace-separated line per answer
+	if dir.Package == "" || strings.ContainsAny(dir.Package, " \t") {
+		return DebconfDirective{}, fmt.Errorf(`invalid package "%s"`, dir.Package)
+	}
+	if dir.Question == "" || strings.ContainsAny(dir.Question, " \t") {
+		return DebconfDirective{}, fmt.Errorf(`invalid question "%s"`, dir.Question)
+	}
+	if !slices.Contains(debconfTypes, dir.Type) {
+		return DebconfDirective{}, fmt.Errorf(`unknown debconf type "%s", expected one of %s`, dir.Type, strings.Join(debconfTypes, ", "))
+	}
+	if strings.ContainsAny(dir.Value, "\r\n") {
+		// Not shown, since it may be secret
+		return DebconfDirective{}, errors.New("debconf value cannot contain a line break")
+	}
+	return dir, nil
+}
+
+// aptconf directives are formatted like, `aptconf "APT::Install-Recommends" "false"`
+func parseAptConfDirective(_ string, args []string, opts map[string]string) (AptConfDirective, error) {
+	if len(args) != 2 {
+		return AptConfDirective{}, fmt.Errorf("expected two arguments, got %v", args)
+	}
+	if len(opts) > 0 {
+		return AptConfDirective{}, fmt.Errorf("unexpected options %v", opts)
+	}
+	dir := AptConfDirective{Key: args[0], Value: args[1]}
+	if !aptConfKeyRegex.MatchString(dir.Key) {
+		return AptConfDirective{}, fmt.Errorf(`invalid apt configuration key "%s", expected like "Acquire::Retries"`, dir.Key)
+	}
+	// apt.conf has no way to escape these inside a value
+	if strings.ContainsAny(dir.Value, "\"\r\n") {
+		return AptConfDirective{}, fmt.Errorf(`apt configuration value for %s cannot contain quotes or line breaks`, dir.Key)
+	}
+	return dir, nil
+}
@@ -2,6 +2,7 @@ package aptfile
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -44,6 +45,41 @@ func TestParseLine(t *testing.T) {
 			line:     "ppa deadsnakes/ppa",
 			expected: PpaDirective{Name: "deadsnakes/ppa"},
 		},
+		{
+			name:     "ppa directive with series and source",
+			line:     `ppa "deadsnakes/ppa", series: "jammy", src: "true"`,
+			expected: PpaDirective{Name: "deadsnakes/ppa", Series: "jammy", IsSrc: true},
+		},
+		{
+			name:     "private ppa directive",
+			line:     `ppa "acme/internal", auth: "env:ACME_PPA", fingerprint: "eb85 bb5f a33a 75e1 5e94 4e63 f231 550c 4f47 e38e"`,
+			expected: PpaDirective{Name: "acme/internal", Auth: "env:ACME_PPA", Fingerprint: "EB85BB5FA33A75E15E944E63F231550C4F47E38E"},
+		},
+		{
+			name:    "ppa directive with bad src",
+			line:    `ppa "deadsnakes/ppa", src: "yes please"`,
+			wantErr: true,
+		},
+		{
+			name:    "ppa directive with inline credentials",
+			line:    `ppa "acme/internal", auth: "user:hunter2"`,
+			wantErr: true,
+		},
+		{
+			name:    "ppa directive with empty auth reference",
+			line:    `ppa "acme/internal", auth: "file:"`,
+			wantErr: true,
+		},
+		{
+			name:    "private ppa directive without fingerprint",
+			line:    `ppa "acme/internal", auth: "env:ACME_PPA"`,
+			wantErr: true,
+		},
+		{
+			name:    "ppa directive with unknown option",
+			line:    `ppa "deadsnakes/ppa", arch: "amd64"`,
+			wantErr: true,
+		},
 		{
 			name: "repo directive",
 			line: `repo "https://example.com/ubuntu" jammy main`,
@@ -64,6 +100,47 @@ func TestParseLine(t *testing.T) {
 				SignedBy:  "https://example.com/key/thing.gpg",
 			},
 		},
+		{
+			name: "repo directive with keyserver",
+			line: `repo "https://example.com/ubuntu" "jammy" "main", keyserver: "hkps://keyserver.ubuntu.com", fingerprint: "eb85 bb5f a33a 75e1 5e94  4e63 f231 550c 4f47 e38e"`,
+			expected: RepoDirective{
+				URL:         "https://example.com/ubuntu",
+				Suite:       "jammy",
+				Component:   "main",
+				Keyserver:   "hkps://keyserver.ubuntu.com",
+				Fingerprint: "EB85BB5FA33A75E15E944E63F231550C4F47E38E",
+			},
+		},
+		{
+			name:    "repo directive with keyserver but no fingerprint",
+			line:    `repo "https://example.com/ubuntu" "jammy" "main", keyserver: "hkps://keyserver.ubuntu.com"`,
+			wantErr: true,
+		},
+		{
+			name:    "repo directive with invalid fingerprint",
+			line:    `repo "https://example.com/ubuntu" "jammy" "main", keyserver: "hkps://keyserver.ubuntu.com", fingerprint: "1234"`,
+			wantErr: true,
+		},
+		{
+			name:    "repo directive with keyserver and signed-by",
+			line:    `repo "https://example.com/ubuntu" "jammy" "main", signed-by: "https://example.com/key.gpg", keyserver: "hkps://keyserver.ubuntu.com", fingerprint: "EB85BB5FA33A75E15E944E63F231550C4F47E38E"`,
+			wantErr: true,
+		},
+		{
+			name: "repo directive with auth",
+			line: `repo "https://artifactory.example.com/debian" "stable" "main", auth: "file:/run/secrets/artifactory"`,
+			expected: RepoDirective{
+				URL:       "https://artifactory.example.com/debian",
+				Suite:     "stable",
+				Component: "main",
+				Auth:      "file:/run/secrets/artifactory",
+			},
+		},
+		{
+			name:    "repo directive with inline credentials",
+			line:    `repo "https://artifactory.example.com/debian" "stable" "main", auth: "alice:hunter2"`,
+			wantErr: true,
+		},
 		{
 			name: "repo-src directive",
 			line: `repo-src "https://example.com/ubuntu" jammy main`,
@@ -79,11 +156,151 @@ func TestParseLine(t *testing.T) {
 			line:     `deb "https://example.com/tool.deb"`,
 			expected: DebFileDirective{Path: "https://example.com/tool.deb"},
 		},
+		{
+			name: "deb directive with checksums",
+			line: `deb "https://example.com/tool.deb", sha256: "E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855", sha512: "cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e"`,
+			expected: DebFileDirective{
+				Path:   "https://example.com/tool.deb",
+				SHA256: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+				SHA512: "cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e",
+			},
+		},
+		{
+			name:    "deb directive with short checksum",
+			line:    `deb "https://example.com/tool.deb", sha256: "e3b0c442"`,
+			wantErr: true,
+		},
+		{
+			name:     "pin directive",
+			line:     `pin "nsight-compute" -1, origin: "*ubuntu.com*"`,
+			expected: PinDirective{PackageName: "nsight-compute", Priority: -1, Origin: "*ubuntu.com*"},
+		},
+		{
+			name:     "pin directive with several release fields",
+			line:     `pin "cuda" 600, release: "o=Ubuntu,a=noble-backports"`,
+			expected: PinDirective{PackageName: "cuda", Priority: 600, Release: "o=Ubuntu,a=noble-backports"},
+		},
+		{
+			// These would be OR-ed together by apt rather than all required
+			name:    "pin directive with several options",
+			line:    `pin "cuda" 600, version: "12.*", release: "l=NVIDIA CUDA"`,
+			wantErr: true,
+		},
+		{
+			name:     "pin directive with several packages",
+			line:     `pin "nvidia-*   /^cuda-[0-9-]+$/ libcudnn9" 600, release: "l=NVIDIA CUDA"`,
+			expected: PinDirective{PackageName: "nvidia-* /^cuda-[0-9-]+$/ libcudnn9", Priority: 600, Release: "l=NVIDIA CUDA"},
+		},
+		{
+			name:     "pin directive for the local system",
+			line:     `pin "*" 100, origin: ""`,
+			expected: PinDirective{PackageName: "*", Priority: 100, Origin: `""`},
+		},
+		{
+			name:    "pin directive with invalid regular expression",
+			line:    `pin "/^cuda-(/" 600, release: "l=NVIDIA CUDA"`,
+			wantErr: true,
+		},
+		{
+			name:    "pin directive without anything to pin to",
+			line:    `pin "cuda" 600`,
+			wantErr: true,
+		},
 		{
 			name:     "hold directive",
 			line:     "hold curl",
 			expected: HoldDirective{PackageName: "curl"},
 		},
+		{
+			name:     "hold directive with version",
+			line:     `hold "docker-ce", version: "5:27.3.1-1~ubuntu.24.04~noble"`,
+			expected: HoldDirective{PackageName: "docker-ce", Version: "5:27.3.1-1~ubuntu.24.04~noble"},
+		},
+		{
+			name:    "hold directive with unknown option",
+			line:    `hold "docker-ce", release: "noble"`,
+			wantErr: true,
+		},
+		{
+			name:     "unhold directive",
+			line:     "unhold curl",
+			expected: UnholdDirective{PackageName: "curl"},
+		},
+		{
+			name:    "unhold directive with options",
+			line:    `unhold "curl", version: "8.5"`,
+			wantErr: true,
+		},
+		{
+			name:     "config directive",
+			line:     `config proxy "http://proxy.internal:3128"`,
+			expected: ConfigDirective{Key: "proxy", Value: "http://proxy.internal:3128"},
+		},
+		{
+			name:    "config directive with unknown key",
+			line:    `config colour "blue"`,
+			wantErr: true,
+		},
+		{
+			name:    "config directive with bad boolean",
+			line:    `config configure-apt "yes please"`,
+			wantErr: true,
+		},
+		{
+			name:     "debconf directive",
+			line:     `debconf "tzdata" "tzdata/Areas" "select" "Etc"`,
+			expected: DebconfDirective{Package: "tzdata", Question: "tzdata/Areas", Type: "select", Value: "Etc"},
+		},
+		{
+			name:     "secret debconf directive",
+			line:     `debconf "mysql-server" "mysql-server/root_password" "password" "hunter2", secret: "true"`,
+			expected: DebconfDirective{Package: "mysql-server", Question: "mysql-server/root_password", Type: "password", Value: "hunter2", IsSecret: true},
+		},
+		{
+			name:     "debconf directive with empty value",
+			line:     `debconf "postfix" "postfix/relayhost" "string" ""`,
+			expected: DebconfDirective{Package: "postfix", Question: "postfix/relayhost", Type: "string"},
+		},
+		{
+			name:    "debconf directive with unknown type",
+			line:    `debconf "tzdata" "tzdata/Areas" "choice" "Etc"`,
+			wantErr: true,
+		},
+		{
+			name:    "debconf directive missing value",
+			line:    `debconf "tzdata" "tzdata/Areas" "select"`,
+			wantErr: true,
+		},
+		{
+			name:    "debconf directive with space in question",
+			line:    `debconf "tzdata" "tzdata Areas" "select" "Etc"`,
+			wantErr: true,
+		},
+		{
+			name:     "aptconf directive",
+			line:     `aptconf "Acquire::Retries" "3"`,
+			expected: AptConfDirective{Key: "Acquire::Retries", Value: "3"},
+		},
+		{
+			name:     "aptconf directive adding to a list",
+			line:     `aptconf "Dpkg::Options::" "--force-confold"`,
+			expected: AptConfDirective{Key: "Dpkg::Options::", Value: "--force-confold"},
+		},
+		{
+			name:    "aptconf directive with command line syntax",
+			line:    `aptconf "Dpkg::Options::=--force-confold" ""`,
+			wantErr: true,
+		},
+		{
+			name:    "aptconf directive with empty key part",
+			line:    `aptconf "APT::::Install-Recommends" "false"`,
+			wantErr: true,
+		},
+		{
+			name:    "aptconf directive missing value",
+			line:    `aptconf "Acquire::Retries"`,
+			wantErr: true,
+		},
 		{
 			name:    "invalid syntax",
 			line:    "package foo: bar",
@@ -115,3 +332,79 @@ func TestParseLine(t *testing.T) {
 		})
 	}
 }
+
+func TestParseHeredoc(t *testing.T) {
+	input := strings.Join([]string{
+		`package curl`,
+		`repo "https://example.com/debian" "stable" "main", signed-by: <<KEY`,
+		`-----BEGIN PGP PUBLIC KEY BLOCK-----`,
+		``,
+		`  bWFkZSB1cA==`,
+		`-----END PGP PUBLIC KEY BLOCK-----`,
+		`  KEY`,
+		`package git`,
+	}, "\n")
+	dirs, err := Parse(strings.NewReader(input))
+	require.NoError(t, err)
+	require.Equal(t, []any{
+		PackageDirective{Name: "curl"},
+		RepoDirective{
+			URL:       "https://example.com/debian",
+			Suite:     "stable",
+			Component: "main",
+			SignedBy:  "-----BEGIN PGP PUBLIC KEY BLOCK-----\n\n  bWFkZSB1cA==\n-----END PGP PUBLIC KEY BLOCK-----\n",
+		},
+		PackageDirective{Name: "git"},
+	}, dirs)
+}
+
+func TestParseHeredocErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{
+			name:  "unterminated",
+			input: "repo \"https://example.com\" \"stable\" \"main\", signed-by: <<KEY\nkey data\n",
+		},
+		{
+			name:  "positional argument",
+			input: "deb <<EOF\ndata\nEOF\n",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tc.input))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestParseQuotedHeredocMarker(t *testing.T) {
+	dirs, err := Parse(strings.NewReader(`repo "https://example.com" "stable" "main", signed-by: "<<KEY"`))
+	require.NoError(t, err)
+	require.Equal(t, "<<KEY", dirs[0].(RepoDirective).SignedBy)
+}
+
+func TestParsePinExplanation(t *testing.T) {
+	input := strings.Join([]string{
+		`# Unrelated`,
+		``,
+		`# Prefer NVIDIA's builds`,
+		`#   over Ubuntu's`,
+		`pin "*" 600, release: "l=NVIDIA CUDA"`,
+		`pin "nsight-compute" -1, origin: "*ubuntu.com*"`,
+		`# Not a pin`,
+		`package curl`,
+		`pin "curl" 500, version: "8.*"`,
+	}, "\n")
+	dirs, err := Parse(strings.NewReader(input))
+	require.NoError(t, err)
+	require.Equal(t, []any{
+		PinDirective{PackageName: "*", Priority: 600, Release: "l=NVIDIA CUDA", Explanation: "Prefer NVIDIA's builds\nover Ubuntu's"},
+		PinDirective{PackageName: "nsight-compute", Priority: -1, Origin: "*ubuntu.com*"},
+		PackageDirective{Name: "curl"},
+		PinDirective{PackageName: "curl", Priority: 500, Version: "8.*"},
+	}, dirs)
+}
@@ -0,0 +1,86 @@
+package armor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const BLOCK_TYPE_SIGNED_MESSAGE = "PGP SIGNED MESSAGE"
+
+// A message using the OpenPGP cleartext signature framework,
+// such as a Debian/Ubuntu InRelease file.
+//
+// https://www.rfc-editor.org/rfc/rfc9580#name-cleartext-signature-framewo
+type SignedMessage struct {
+	// Hash algorithms listed in the "Hash:" armor headers, e.g. "SHA512"
+	Hashes []string
+	// The signed text with dash-escaping removed. Lines are separated
+	// by "\n", and the line ending just before the signature is not
+	// part of the signed text.
+	Text []byte
+	// The armored signature following the text
+	Signature *Block
+}
+
+// Parse a cleartext-signed message. The signature is decoded but not
+// verified.
+func ParseCleartext(r io.Reader) (*SignedMessage, error) {
+	beginLine := fmt.Sprintf("-----BEGIN %s-----", BLOCK_TYPE_SIGNED_MESSAGE)
+	sigBeginLine := fmt.Sprintf("-----BEGIN %s-----", BLOCK_TYPE_SIGNATURE)
+	var state = ARMOR_PARSER_STATE_HEADERLINE
+	var msg SignedMessage
+	var textLines []string
+	var sigBuilder strings.Builder
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		switch state {
+		case ARMOR_PARSER_STATE_HEADERLINE:
+			if strings.TrimSpace(line) == beginLine {
+				state = ARMOR_PARSER_STATE_HEADER
+			} else if strings.TrimSpace(line) != "" {
+				return nil, fmt.Errorf("no cleartext header line found. Found '%v'", line)
+			}
+		case ARMOR_PARSER_STATE_HEADER:
+			line = strings.TrimSpace(line)
+			if m := armorHeader.FindStringSubmatch(line); m != nil {
+				if m[1] != "Hash" {
+					return nil, fmt.Errorf("unexpected cleartext header '%v'", m[1])
+				}
+				for _, h := range strings.Split(m[2], ",") {
+					msg.Hashes = append(msg.Hashes, strings.TrimSpace(h))
+				}
+			} else if line == "" {
+				state = ARMOR_PARSER_STATE_BODY
+			} else {
+				return nil, fmt.Errorf("no end of header line. Found '%v'", line)
+			}
+		case ARMOR_PARSER_STATE_BODY:
+			if strings.TrimSpace(line) == sigBeginLine {
+				state = ARMOR_PARSER_STATE_FOOTER
+				sigBuilder.WriteString(sigBeginLine + "\n")
+				continue
+			}
+			// Lines beginning with a dash are escaped by prefixing "- "
+			textLines = append(textLines, strings.TrimPrefix(line, "- "))
+		case ARMOR_PARSER_STATE_FOOTER:
+			sigBuilder.WriteString(line + "\n")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if state != ARMOR_PARSER_STATE_FOOTER {
+		return nil, fmt.Errorf("%w: no signature found after cleartext", ErrArmorParse)
+	}
+	msg.Text = []byte(strings.Join(textLines, "\n"))
+
+	sig, err := Parse(strings.NewReader(sigBuilder.String()))
+	if err != nil {
+		return nil, err
+	}
+	msg.Signature = sig
+	return &msg, nil
+}
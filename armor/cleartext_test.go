@@ -0,0 +1,84 @@
+package armor
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCleartextInRelease(t *testing.T) {
+	content, err := os.ReadFile(filepath.Join("..", "test_data", "repos", "bob", "dists", "stable", "InRelease"))
+	require.NoError(t, err)
+
+	msg, err := ParseCleartext(bytes.NewReader(content))
+	require.NoError(t, err)
+	require.Equal(t, []string{"SHA512"}, msg.Hashes)
+	require.True(t, bytes.HasPrefix(msg.Text, []byte("Origin: Example\n")))
+	require.True(t, bytes.HasSuffix(msg.Text, []byte("\n-- trailing line that starts with a dash")))
+	require.Equal(t, BLOCK_TYPE_SIGNATURE, msg.Signature.Type)
+	require.NotEmpty(t, msg.Signature.Body)
+}
+
+func TestParseCleartext(t *testing.T) {
+	var sig bytes.Buffer
+	require.NoError(t, Encode(&sig, BLOCK_TYPE_SIGNATURE, nil, []byte("signature")))
+
+	tests := []struct {
+		name       string
+		input      string
+		wantHashes []string
+		wantText   string
+		wantErr    bool
+	}{
+		{
+			name:       "multiple hashes",
+			input:      "-----BEGIN PGP SIGNED MESSAGE-----\nHash: SHA256, SHA512\nHash: SHA1\n\nhello\n" + sig.String(),
+			wantHashes: []string{"SHA256", "SHA512", "SHA1"},
+			wantText:   "hello",
+		},
+		{
+			name:       "CRLF line endings and dash escapes",
+			input:      "-----BEGIN PGP SIGNED MESSAGE-----\r\nHash: SHA256\r\n\r\n- -----BEGIN\r\n- - x\r\nplain\r\n" + sig.String(),
+			wantHashes: []string{"SHA256"},
+			wantText:   "-----BEGIN\n- x\nplain",
+		},
+		{
+			name:     "no hash header",
+			input:    "-----BEGIN PGP SIGNED MESSAGE-----\n\nline one\n\nline three\n" + sig.String(),
+			wantText: "line one\n\nline three",
+		},
+		{
+			name:    "missing signature",
+			input:   "-----BEGIN PGP SIGNED MESSAGE-----\nHash: SHA256\n\nhello\n",
+			wantErr: true,
+		},
+		{
+			name:    "not a signed message",
+			input:   sig.String(),
+			wantErr: true,
+		},
+		{
+			name:    "unexpected header",
+			input:   "-----BEGIN PGP SIGNED MESSAGE-----\nComment: hi\n\nhello\n" + sig.String(),
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			msg, err := ParseCleartext(strings.NewReader(tc.input))
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.wantHashes, msg.Hashes)
+			require.Equal(t, tc.wantText, string(msg.Text))
+			require.Equal(t, []byte("signature"), msg.Signature.Body)
+		})
+	}
+}
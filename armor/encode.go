@@ -0,0 +1,55 @@
+package armor
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"slices"
+)
+
+const ENCODED_LINE_LENGTH = 64
+
+// Write body as an ASCII-armored block of the given type, e.g.
+// BLOCK_TYPE_PUBLIC_KEY. Headers are written in sorted key order
+// so the output is deterministic.
+func Encode(w io.Writer, blockType string, headers map[string][]string, body []byte) error {
+	bw := bufio.NewWriter(w)
+	if _, err := fmt.Fprintf(bw, "-----BEGIN %s-----\n", blockType); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		if !armorHeaderKey.MatchString(k) {
+			return fmt.Errorf("invalid armor header key %q", k)
+		}
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		for _, v := range headers[k] {
+			if _, err := fmt.Fprintf(bw, "%s: %s\n", k, v); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := bw.WriteString("\n"); err != nil {
+		return err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(body)
+	for len(encoded) > 0 {
+		n := min(len(encoded), ENCODED_LINE_LENGTH)
+		if _, err := fmt.Fprintf(bw, "%s\n", encoded[:n]); err != nil {
+			return err
+		}
+		encoded = encoded[n:]
+	}
+
+	crc := crc24(body)
+	checksum := base64.StdEncoding.EncodeToString([]byte{byte(crc >> 16), byte(crc >> 8), byte(crc)})
+	if _, err := fmt.Fprintf(bw, "=%s\n-----END %s-----\n", checksum, blockType); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
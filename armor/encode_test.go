@@ -0,0 +1,79 @@
+package armor
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		blockType string
+		headers   map[string][]string
+		body      []byte
+	}{
+		{
+			name:      "empty body",
+			blockType: BLOCK_TYPE_PUBLIC_KEY,
+			body:      []byte{},
+		},
+		{
+			name:      "short body with headers",
+			blockType: BLOCK_TYPE_SIGNATURE,
+			headers: map[string][]string{
+				"Comment": {"first", "second"},
+				"Version": {"adapt"},
+			},
+			body: []byte("123456789"),
+		},
+		{
+			name:      "exactly one line",
+			blockType: BLOCK_TYPE_MESSAGE,
+			body:      bytes.Repeat([]byte{0xAB}, 48),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, Encode(&buf, tc.blockType, tc.headers, tc.body))
+			block, err := NewDecoder(&buf).Next()
+			require.NoError(t, err)
+			require.Equal(t, tc.blockType, block.Type)
+			require.Equal(t, tc.body, block.Body)
+			for k, v := range tc.headers {
+				require.Equal(t, v, block.Headers[k])
+			}
+		})
+	}
+}
+
+func TestEncodeMatchesGPGOutput(t *testing.T) {
+	binary, err := os.ReadFile(filepath.Join("..", "test_data", "key.gpg"))
+	require.NoError(t, err)
+	expected, err := os.ReadFile(filepath.Join("..", "test_data", "key.gpg.asc"))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, Encode(&buf, BLOCK_TYPE_PUBLIC_KEY, nil, binary))
+	require.Equal(t, string(expected), buf.String())
+}
+
+func TestEncodeLineLength(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Encode(&buf, BLOCK_TYPE_MESSAGE, nil, bytes.Repeat([]byte{1, 2, 3}, 100)))
+	for _, line := range strings.Split(buf.String(), "\n") {
+		require.LessOrEqual(t, len(line), ENCODED_LINE_LENGTH)
+	}
+}
+
+func TestEncodeRejectsBadHeaderKey(t *testing.T) {
+	var buf bytes.Buffer
+	err := Encode(&buf, BLOCK_TYPE_MESSAGE, map[string][]string{"Bad Key": {"x"}}, []byte("x"))
+	require.Error(t, err)
+}
@@ -12,8 +12,9 @@ import (
 )
 
 var (
-	armorHeaderLine = regexp.MustCompile(`^-----BEGIN .+-----$`)
-	armorHeader     = regexp.MustCompile(`^[a-zA-Z]+: .+$`)
+	armorHeaderLine = regexp.MustCompile(`^-----BEGIN (.+)-----$`)
+	armorHeader     = regexp.MustCompile(`^([a-zA-Z]+): (.+)$`)
+	armorHeaderKey  = regexp.MustCompile(`^[a-zA-Z]+$`)
 	ErrArmorParse   = errors.New("error parsing ASCII armor format")
 	ErrBadChecksum  = errors.New("calculated checksum does not match expected value")
 )
@@ -26,92 +27,152 @@ const (
 	ARMOR_PARSER_STATE_DONE
 )
 
+// Block types, as they appear between "-----BEGIN " and "-----"
+const (
+	BLOCK_TYPE_PUBLIC_KEY  = "PGP PUBLIC KEY BLOCK"
+	BLOCK_TYPE_PRIVATE_KEY = "PGP PRIVATE KEY BLOCK"
+	BLOCK_TYPE_SIGNATURE   = "PGP SIGNATURE"
+	BLOCK_TYPE_MESSAGE     = "PGP MESSAGE"
+)
+
+// A single decoded armored block
+type Block struct {
+	// e.g. "PGP PUBLIC KEY BLOCK"
+	Type string
+	// Armor headers like "Comment" or "Version". A header may be
+	// repeated, so values are kept in the order they appeared.
+	Headers map[string][]string
+	Body    []byte
+}
+
+// Reads a series of armored blocks from a stream, such as a
+// file containing several concatenated public keys.
+type Decoder struct {
+	scanner *bufio.Scanner
+	// Number of blocks read so far
+	blocks int
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{scanner: bufio.NewScanner(r)}
+}
+
 // Convert the ASCII 'armored' PGP public key to a pure
 // binary blob that can be written to disk or otherwise
-// used for checking signatures.
+// used for checking signatures. Only the first armored
+// block is returned; use a Decoder to read all of them.
+//
+// The block type and armor headers are returned alongside
+// the body so callers can check that, e.g., they were given
+// a public key rather than a signature.
 //
 // https://openpgp.dev/book/armor.html
-func Parse(r io.Reader) (body []byte, err error) {
+func Parse(r io.Reader) (*Block, error) {
+	block, err := NewDecoder(r).Next()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%w: no armored block found", ErrArmorParse)
+	} else if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// The first value of the given header, or "" if it is not present
+func (b *Block) Header(key string) string {
+	if vals := b.Headers[key]; len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+// Read the next armored block. Returns io.EOF once the input
+// is exhausted without finding the start of another block.
+// Text before the first block is an error, but once a block
+// has been read, any text between or after blocks is skipped
+// (RFC 4880 section 6.2).
+func (d *Decoder) Next() (block *Block, err error) {
 	var checksum uint32
 	var state = ARMOR_PARSER_STATE_HEADERLINE
 	var encodedKeyBuilder strings.Builder
 	var expectedFooterLineText string
-	scanner := bufio.NewScanner(r)
+	block = &Block{Headers: make(map[string][]string)}
 scanning:
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
+	for d.scanner.Scan() {
+		line := strings.TrimSpace(d.scanner.Text())
 		switch state {
 		case ARMOR_PARSER_STATE_HEADERLINE:
-			if armorHeaderLine.MatchString(line) {
+			if m := armorHeaderLine.FindStringSubmatch(line); m != nil {
+				block.Type = m[1]
 				expectedFooterLineText = strings.Replace(line, "BEGIN", "END", 1)
 				state = ARMOR_PARSER_STATE_HEADER
 				continue
-			} else if line == "" {
+			} else if line == "" || d.blocks > 0 {
 				continue
 			} else {
 				err = fmt.Errorf("no header line found. Found '%v'", line)
-				return
+				return nil, err
 			}
 		case ARMOR_PARSER_STATE_HEADER:
-			if armorHeader.MatchString(line) {
+			if m := armorHeader.FindStringSubmatch(line); m != nil {
+				block.Headers[m[1]] = append(block.Headers[m[1]], m[2])
 				continue
 			} else if line == "" {
 				state = ARMOR_PARSER_STATE_BODY
 				continue
 			} else {
 				err = fmt.Errorf("no end of header line. Found '%v'", line)
-				return
+				return nil, err
 			}
 		case ARMOR_PARSER_STATE_BODY:
 			if len(line) == 5 && line[0] == byte('=') {
 				state = ARMOR_PARSER_STATE_FOOTER
 				checksumBase64 := strings.TrimLeft(line, "=")
 				var checksumBytes [4]byte
-				var err2 error
 				decoded, err2 := base64.StdEncoding.DecodeString(checksumBase64)
 				if err2 != nil {
-					err = err2
-					return
+					return nil, err2
 				}
 				copy(checksumBytes[1:4], decoded)
 				checksum = binary.BigEndian.Uint32(checksumBytes[:])
 				continue
 			} else if line == expectedFooterLineText {
 				state = ARMOR_PARSER_STATE_DONE
-				continue
+				break scanning
 			}
 			_, err = encodedKeyBuilder.WriteString(line)
 			if err != nil {
-				return
+				return nil, err
 			}
 		case ARMOR_PARSER_STATE_FOOTER:
 			if line == expectedFooterLineText {
 				state = ARMOR_PARSER_STATE_DONE
+				break scanning
 			} else {
 				err = fmt.Errorf(`no footer line. Expected: "%v". Found "%v"`, expectedFooterLineText, line)
-				return
+				return nil, err
 			}
-		case ARMOR_PARSER_STATE_DONE:
-			// Discard rest of input
-			break scanning
 		}
 	}
-	if err = scanner.Err(); err != nil {
-		return
+	if err = d.scanner.Err(); err != nil {
+		return nil, err
+	}
+	if state == ARMOR_PARSER_STATE_HEADERLINE {
+		return nil, io.EOF
 	}
 	if state != ARMOR_PARSER_STATE_DONE {
 		err = fmt.Errorf("did not reach final parse state. Was in state %v", state)
-		return
+		return nil, err
 	}
-	body, err = base64.StdEncoding.DecodeString(encodedKeyBuilder.String())
+	block.Body, err = base64.StdEncoding.DecodeString(encodedKeyBuilder.String())
 	if err != nil {
-		return
+		return nil, err
 	}
 	// Checksums can be optional
-	if checksum != 0 && checksum != crc24(body) {
-		return []byte(""), ErrBadChecksum
+	if checksum != 0 && checksum != crc24(block.Body) {
+		return nil, ErrBadChecksum
 	}
-	return
+	d.blocks++
+	return block, nil
 }
 
 const (
@@ -2,8 +2,10 @@ package armor
 
 import (
 	"bytes"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -75,5 +77,90 @@ func TestBodyDecode(t *testing.T) {
 	require.NoError(t, err)
 	actual, err := Parse(bytes.NewReader(armored))
 	require.NoError(t, err)
-	require.Equal(t, expected, actual)
+	require.Equal(t, BLOCK_TYPE_PUBLIC_KEY, actual.Type)
+	require.Equal(t, expected, actual.Body)
+}
+
+func TestDecoderMultipleBlocks(t *testing.T) {
+	var input []byte
+	for _, f := range []string{"alice_cert.asc", "bob_cert.asc", "key.gpg.asc"} {
+		content, err := os.ReadFile(filepath.Join("..", "test_data", f))
+		require.NoError(t, err)
+		input = append(input, content...)
+		input = append(input, '\n')
+	}
+
+	dec := NewDecoder(bytes.NewReader(input))
+	for range 3 {
+		block, err := dec.Next()
+		require.NoError(t, err)
+		require.Equal(t, BLOCK_TYPE_PUBLIC_KEY, block.Type)
+		require.NotEmpty(t, block.Body)
+	}
+	_, err := dec.Next()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestDecoderSkipsTextAfterBlock(t *testing.T) {
+	content, err := os.ReadFile(filepath.Join("..", "test_data", "key.gpg.asc"))
+	require.NoError(t, err)
+	alice, err := os.ReadFile(filepath.Join("..", "test_data", "alice_cert.asc"))
+	require.NoError(t, err)
+
+	input := append([]byte{}, content...)
+	input = append(input, "This key is used to sign the stable repository.\n\n"...)
+	input = append(input, alice...)
+	input = append(input, "Fetched from https://example.com/keys\n"...)
+
+	dec := NewDecoder(bytes.NewReader(input))
+	for range 2 {
+		block, err := dec.Next()
+		require.NoError(t, err)
+		require.Equal(t, BLOCK_TYPE_PUBLIC_KEY, block.Type)
+	}
+	_, err = dec.Next()
+	require.ErrorIs(t, err, io.EOF)
+
+	// Text before the first block is still rejected
+	_, err = NewDecoder(bytes.NewReader(append([]byte("Some prose\n"), content...))).Next()
+	require.ErrorContains(t, err, "no header line found")
+}
+
+func TestDecoderHeaders(t *testing.T) {
+	content, err := os.ReadFile(filepath.Join("..", "test_data", "alice_cert.asc"))
+	require.NoError(t, err)
+	block, err := NewDecoder(bytes.NewReader(content)).Next()
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"Alice's OpenPGP certificate",
+		"https://www.ietf.org/id/draft-bre-openpgp-samples-01.html",
+	}, block.Headers["Comment"])
+}
+
+func TestDecoderTruncatedBlock(t *testing.T) {
+	content, err := os.ReadFile(filepath.Join("..", "test_data", "key.gpg.asc"))
+	require.NoError(t, err)
+	dec := NewDecoder(bytes.NewReader(content[:len(content)/2]))
+	_, err = dec.Next()
+	require.Error(t, err)
+	require.NotErrorIs(t, err, io.EOF)
+}
+
+func TestParseHeaders(t *testing.T) {
+	content, err := os.ReadFile(filepath.Join("..", "test_data", "bob_cert.asc"))
+	require.NoError(t, err)
+	block, err := Parse(bytes.NewReader(content))
+	require.NoError(t, err)
+	require.Equal(t, BLOCK_TYPE_PUBLIC_KEY, block.Type)
+	require.Equal(t, "Bob's OpenPGP certificate", block.Header("Comment"))
+	require.Equal(t, "", block.Header("Version"))
+}
+
+func TestParseSignatureType(t *testing.T) {
+	input := "-----BEGIN PGP SIGNATURE-----\nVersion: test\n\nMTIzNDU2Nzg5\n=Ic8C\n-----END PGP SIGNATURE-----\n"
+	block, err := Parse(strings.NewReader(input))
+	require.NoError(t, err)
+	require.Equal(t, BLOCK_TYPE_SIGNATURE, block.Type)
+	require.Equal(t, "test", block.Header("Version"))
+	require.Equal(t, []byte("123456789"), block.Body)
 }
@@ -0,0 +1,183 @@
+// Package deb reads the metadata of Debian binary packages (.deb files)
+// without needing dpkg, so that a download can be checked before it is
+// handed to `dpkg -i`.
+//
+// https://manpages.debian.org/stable/dpkg-dev/deb.5.en.html
+package deb
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrNotDeb                 = errors.New("not a Debian binary package")
+	ErrUnsupportedCompression = errors.New("unsupported control archive compression")
+)
+
+const (
+	AR_MAGIC          = "!<arch>\n"
+	AR_HEADER_SIZE    = 60
+	AR_FILE_MAGIC     = "`\n"
+	DEBIAN_BINARY     = "debian-binary"
+	CONTROL_TAR       = "control.tar"
+	SUPPORTED_VERSION = "2."
+)
+
+// Fields from the package's control file
+type Control struct {
+	Package      string
+	Version      string
+	Architecture string
+	// All fields, including the ones above
+	Fields map[string]string
+}
+
+// Read the control information from a .deb. The archive structure is
+// checked along the way, so this fails on anything that is not a .deb,
+// like an HTML error page. If the control archive uses a compression
+// that can't be read here, the error wraps ErrUnsupportedCompression
+// and names the archive member.
+func ReadControl(r io.Reader) (*Control, error) {
+	magic := make([]byte, len(AR_MAGIC))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != AR_MAGIC {
+		return nil, fmt.Errorf("%w: missing ar archive header", ErrNotDeb)
+	}
+
+	first := true
+	for {
+		name, size, err := readArHeader(r)
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: no %s member", ErrNotDeb, CONTROL_TAR)
+		} else if err != nil {
+			return nil, err
+		}
+		member := io.LimitReader(r, size)
+		switch {
+		case first:
+			if name != DEBIAN_BINARY {
+				return nil, fmt.Errorf(`%w: first member is "%s", not "%s"`, ErrNotDeb, name, DEBIAN_BINARY)
+			}
+			version, err := io.ReadAll(member)
+			if err != nil {
+				return nil, err
+			}
+			if !strings.HasPrefix(string(version), SUPPORTED_VERSION) {
+				return nil, fmt.Errorf(`%w: unsupported format version "%s"`, ErrNotDeb, strings.TrimSpace(string(version)))
+			}
+			first = false
+		case strings.HasPrefix(name, CONTROL_TAR):
+			tarReader, err := decompress(name, member)
+			if err != nil {
+				return nil, err
+			}
+			return readControlTar(tarReader)
+		}
+		// Skip whatever is left of the member, plus padding to an even offset
+		if _, err := io.Copy(io.Discard, member); err != nil {
+			return nil, err
+		}
+		if size%2 == 1 {
+			if _, err := io.CopyN(io.Discard, r, 1); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func readArHeader(r io.Reader) (string, int64, error) {
+	var hdr [AR_HEADER_SIZE]byte
+	if _, err := io.ReadFull(r, hdr[:]); err == io.EOF {
+		return "", 0, io.EOF
+	} else if err != nil {
+		return "", 0, fmt.Errorf("%w: truncated ar member header", ErrNotDeb)
+	}
+	if string(hdr[58:60]) != AR_FILE_MAGIC {
+		return "", 0, fmt.Errorf("%w: bad ar member header", ErrNotDeb)
+	}
+	// GNU ar terminates names with "/"
+	name := strings.TrimSuffix(strings.TrimSpace(string(hdr[0:16])), "/")
+	size, err := strconv.ParseInt(strings.TrimSpace(string(hdr[48:58])), 10, 64)
+	if err != nil || size < 0 {
+		return "", 0, fmt.Errorf("%w: bad ar member size", ErrNotDeb)
+	}
+	return name, size, nil
+}
+
+func decompress(name string, r io.Reader) (io.Reader, error) {
+	switch name {
+	case CONTROL_TAR:
+		return r, nil
+	case CONTROL_TAR + ".gz":
+		return gzip.NewReader(r)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedCompression, name)
+	}
+}
+
+func readControlTar(r io.Reader) (*Control, error) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: no control file in %s", ErrNotDeb, CONTROL_TAR)
+		} else if err != nil {
+			return nil, err
+		}
+		if path.Clean(hdr.Name) == "control" {
+			return ParseControl(tr)
+		}
+	}
+}
+
+// Parse a control file in deb822 format, e.g. the output of
+// `dpkg-deb --field`. Continuation lines are folded into the field.
+func ParseControl(r io.Reader) (*Control, error) {
+	fields := make(map[string]string)
+	var last string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if last == "" {
+				return nil, fmt.Errorf("continuation line without a field: '%v'", line)
+			}
+			fields[last] += "\n" + strings.TrimSpace(line)
+			continue
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("expected field in control file, found '%v'", line)
+		}
+		last = strings.TrimSpace(k)
+		fields[last] = strings.TrimSpace(v)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	c := &Control{
+		Package:      fields["Package"],
+		Version:      fields["Version"],
+		Architecture: fields["Architecture"],
+		Fields:       fields,
+	}
+	if c.Package == "" || c.Version == "" || c.Architecture == "" {
+		return nil, fmt.Errorf("%w: control file is missing Package, Version or Architecture", ErrNotDeb)
+	}
+	return c, nil
+}
+
+// e.g. "curl 8.5.0-2ubuntu10 (amd64)"
+func (c *Control) String() string {
+	return fmt.Sprintf("%s %s (%s)", c.Package, c.Version, c.Architecture)
+}
@@ -0,0 +1,76 @@
+package deb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadControl(t *testing.T) {
+	tests := []struct {
+		file string
+		arch string
+	}{
+		{file: "adapt-test_1.0-1_all.deb", arch: "all"},
+		{file: "adapt-test_1.0-1_s390x.deb", arch: "s390x"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.file, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("..", "test_data", "debs", tc.file))
+			require.NoError(t, err)
+			defer func() { require.NoError(t, f.Close()) }()
+
+			c, err := ReadControl(f)
+			require.NoError(t, err)
+			require.Equal(t, "adapt-test", c.Package)
+			require.Equal(t, "1.0-1", c.Version)
+			require.Equal(t, tc.arch, c.Architecture)
+			require.Equal(t, "Test fixture for adapt\nUsed to check .deb validation.", c.Fields["Description"])
+		})
+	}
+}
+
+func TestReadControlUnsupportedCompression(t *testing.T) {
+	content, err := os.ReadFile(filepath.Join("..", "test_data", "debs", "adapt-test-xz_1.0-1_s390x.deb"))
+	require.NoError(t, err)
+	_, err = ReadControl(bytes.NewReader(content))
+	require.ErrorIs(t, err, ErrUnsupportedCompression)
+	require.ErrorContains(t, err, "control.tar.xz")
+}
+
+func TestReadControlRejectsNonDeb(t *testing.T) {
+	valid, err := os.ReadFile(filepath.Join("..", "test_data", "debs", "adapt-test_1.0-1_all.deb"))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{name: "html error page", input: []byte("<!DOCTYPE html><html><body>404 Not Found</body></html>")},
+		{name: "empty", input: []byte{}},
+		{name: "other ar archive", input: []byte("!<arch>\nfoo.o/          0           0     0     644     4         `\nabcd")},
+		{name: "truncated", input: valid[:100]},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ReadControl(bytes.NewReader(tc.input))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestParseControl(t *testing.T) {
+	c, err := ParseControl(strings.NewReader("Package: curl\nVersion: 8.5.0-2ubuntu10\nArchitecture: amd64\nDepends: libc6 (>= 2.34),\n libcurl4t64\n"))
+	require.NoError(t, err)
+	require.Equal(t, "curl 8.5.0-2ubuntu10 (amd64)", c.String())
+	require.Equal(t, "libc6 (>= 2.34),\nlibcurl4t64", c.Fields["Depends"])
+
+	_, err = ParseControl(strings.NewReader("Package: curl\n"))
+	require.ErrorIs(t, err, ErrNotDeb)
+}
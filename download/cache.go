@@ -0,0 +1,230 @@
+package download
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const DEFAULT_CACHE_DIR = "/var/cache/adapt"
+
+// A download cache. File contents are stored once under their SHA-256
+// digest, and each URL has a small entry recording which content it
+// last returned along with the validators (ETag, Last-Modified) needed
+// to check whether that is still current.
+//
+//	<dir>/blobs/<sha256>
+//	<dir>/urls/<sha256 of URL>.json
+type Cache struct {
+	Dir string
+}
+
+type cacheEntry struct {
+	URL          string    `json:"url"`
+	SHA256       string    `json:"sha256"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	LastUsed     time.Time `json:"last_used"`
+}
+
+// What Prune removed
+type PruneResult struct {
+	Entries int
+	Blobs   int
+	Bytes   int64
+}
+
+// Open a cache in dir, creating it if needed
+func NewCache(dir string) (*Cache, error) {
+	c := &Cache{Dir: dir}
+	for _, d := range []string{c.blobDir(), c.entryDir()} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *Cache) blobDir() string {
+	return filepath.Join(c.Dir, "blobs")
+}
+
+func (c *Cache) entryDir() string {
+	return filepath.Join(c.Dir, "urls")
+}
+
+func (c *Cache) blobPath(digest string) string {
+	return filepath.Join(c.blobDir(), digest)
+}
+
+func (c *Cache) entryPath(url string) string {
+	digest := sha256.Sum256([]byte(url))
+	return filepath.Join(c.entryDir(), hex.EncodeToString(digest[:])+".json")
+}
+
+func (c *Cache) hasBlob(digest string) bool {
+	_, err := os.Stat(c.blobPath(digest))
+	return err == nil
+}
+
+// The entry for url, if there is one and its content is still cached
+func (c *Cache) lookup(url string) (*cacheEntry, bool) {
+	data, err := os.ReadFile(c.entryPath(url))
+	if err != nil {
+		return nil, false
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.URL != url || !c.hasBlob(entry.SHA256) {
+		return nil, false
+	}
+	return &entry, true
+}
+
+// Write an entry atomically, so concurrent downloads never see half of one
+func (c *Cache) save(entry *cacheEntry) error {
+	entry.LastUsed = time.Now()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(c.entryDir(), ".entry-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.entryPath(entry.URL))
+}
+
+// Return the path of a cached copy of rawURL, downloading it if it is not
+// cached or the server reports that it has changed.
+func (c *Cache) fetch(ctx context.Context, client *Client, rawURL string, expectedSHA256 string) (string, error) {
+	if expectedSHA256 != "" && c.hasBlob(expectedSHA256) {
+		log.Printf("Using cached copy of %s", rawURL)
+		entry := &cacheEntry{URL: rawURL, SHA256: expectedSHA256}
+		if old, ok := c.lookup(rawURL); ok && old.SHA256 == expectedSHA256 {
+			entry = old
+		}
+		return c.blobPath(expectedSHA256), c.save(entry)
+	}
+
+	header := http.Header{}
+	entry, cached := c.lookup(rawURL)
+	if cached {
+		if entry.ETag != "" {
+			header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+
+	tmp, err := os.CreateTemp(c.blobDir(), ".download-*")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err2 := os.Remove(tmp.Name()); err2 != nil && !errors.Is(err2, fs.ErrNotExist) {
+			log.Printf("Error cleaning up temp file: %v", err2)
+		}
+	}()
+	notModified := false
+	var fetched cacheEntry
+	err = client.fetch(ctx, rawURL, header, func(resp *http.Response) error {
+		if resp.StatusCode == http.StatusNotModified {
+			notModified = true
+			return nil
+		}
+		h := sha256.New()
+		if err := overwrite(tmp, resp.Body, h); err != nil {
+			return err
+		}
+		fetched = cacheEntry{
+			URL:          rawURL,
+			SHA256:       hex.EncodeToString(h.Sum(nil)),
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+		}
+		return nil
+	})
+	if err2 := tmp.Close(); err2 != nil && err == nil {
+		err = err2
+	}
+	if err != nil {
+		return "", err
+	}
+	if notModified {
+		log.Printf("Using cached copy of %s", rawURL)
+		return c.blobPath(entry.SHA256), c.save(entry)
+	}
+	if err := os.Rename(tmp.Name(), c.blobPath(fetched.SHA256)); err != nil {
+		return "", err
+	}
+	return c.blobPath(fetched.SHA256), c.save(&fetched)
+}
+
+// Remove entries not used within maxAge, then any content no longer
+// referenced by an entry
+func (c *Cache) Prune(maxAge time.Duration) (PruneResult, error) {
+	var result PruneResult
+	cutoff := time.Now().Add(-maxAge)
+	referenced := make(map[string]bool)
+
+	entries, err := os.ReadDir(c.entryDir())
+	if err != nil {
+		return result, err
+	}
+	for _, e := range entries {
+		path := filepath.Join(c.entryDir(), e.Name())
+		var entry cacheEntry
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &entry)
+		}
+		if err == nil && entry.LastUsed.After(cutoff) {
+			referenced[entry.SHA256] = true
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return result, err
+		}
+		result.Entries++
+	}
+
+	blobs, err := os.ReadDir(c.blobDir())
+	if err != nil {
+		return result, err
+	}
+	for _, b := range blobs {
+		// Dot files are downloads still in progress
+		if referenced[b.Name()] || strings.HasPrefix(b.Name(), ".") {
+			continue
+		}
+		info, err := b.Info()
+		if err != nil {
+			return result, err
+		}
+		if err := os.Remove(filepath.Join(c.blobDir(), b.Name())); err != nil {
+			return result, err
+		}
+		result.Blobs++
+		result.Bytes += info.Size()
+	}
+	return result, nil
+}
@@ -0,0 +1,138 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testFile struct {
+	content []byte
+	etag    string
+	modTime time.Time
+}
+
+// A server for one file which answers conditional requests, counting
+// how many times it sent the full content
+func newCachingServer(file *testFile, useETag bool) (*httptest.Server, *atomic.Int32) {
+	var fullResponses atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		if useETag {
+			rec.Header().Set("ETag", file.etag)
+		}
+		http.ServeContent(rec, r, "file", file.modTime, bytes.NewReader(file.content))
+		if rec.Code == http.StatusOK {
+			fullResponses.Add(1)
+		}
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		_, _ = w.Write(rec.Body.Bytes())
+	}))
+	return server, &fullResponses
+}
+
+func newCachedTestClient(t *testing.T, server *httptest.Server) *Client {
+	t.Helper()
+	cache, err := NewCache(t.TempDir())
+	require.NoError(t, err)
+	client := newTestClient(server, 0)
+	client.Cache = cache
+	return client
+}
+
+func TestCacheRevalidates(t *testing.T) {
+	for _, useETag := range []bool{true, false} {
+		name := "last-modified"
+		if useETag {
+			name = "etag"
+		}
+		t.Run(name, func(t *testing.T) {
+			file := &testFile{content: []byte("key v1"), etag: `"v1"`, modTime: time.Unix(1700000000, 0)}
+			server, fullResponses := newCachingServer(file, useETag)
+			defer server.Close()
+			client := newCachedTestClient(t, server)
+
+			for range 2 {
+				body, err := client.GetCached(context.Background(), server.URL)
+				require.NoError(t, err)
+				require.Equal(t, "key v1", string(body))
+			}
+			require.Equal(t, int32(1), fullResponses.Load())
+
+			file.content, file.etag, file.modTime = []byte("key v2"), `"v2"`, file.modTime.Add(time.Hour)
+			body, err := client.GetCached(context.Background(), server.URL)
+			require.NoError(t, err)
+			require.Equal(t, "key v2", string(body))
+			require.Equal(t, int32(2), fullResponses.Load())
+		})
+	}
+}
+
+func TestCacheUsesChecksumWithoutRequest(t *testing.T) {
+	file := &testFile{content: []byte("deb contents")}
+	server, fullResponses := newCachingServer(file, false)
+	defer server.Close()
+	client := newCachedTestClient(t, server)
+	digest := sha256.Sum256(file.content)
+	expected := hex.EncodeToString(digest[:])
+
+	path, release, err := client.GetFile(context.Background(), server.URL+"/tool.deb", expected)
+	require.NoError(t, err)
+	release()
+	require.Equal(t, filepath.Join(client.Cache.Dir, "blobs", expected), path)
+
+	// Same content under a different URL, e.g. a mirror
+	server.Close()
+	path, release, err = client.GetFile(context.Background(), server.URL+"/mirror/tool.deb", expected)
+	require.NoError(t, err)
+	release()
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, file.content, content)
+	require.Equal(t, int32(1), fullResponses.Load())
+}
+
+func TestCachePrune(t *testing.T) {
+	file := &testFile{content: []byte("old"), etag: `"old"`}
+	server, _ := newCachingServer(file, true)
+	defer server.Close()
+	client := newCachedTestClient(t, server)
+
+	_, err := client.GetCached(context.Background(), server.URL+"/old")
+	require.NoError(t, err)
+	file.content, file.etag = []byte("new"), `"new"`
+	_, err = client.GetCached(context.Background(), server.URL+"/new")
+	require.NoError(t, err)
+
+	// Backdate the entry for the old URL
+	entryPath := client.Cache.entryPath(server.URL + "/old")
+	var entry cacheEntry
+	data, err := os.ReadFile(entryPath)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &entry))
+	entry.LastUsed = time.Now().Add(-48 * time.Hour)
+	data, err = json.Marshal(entry)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(entryPath, data, 0644))
+
+	result, err := client.Cache.Prune(24 * time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, PruneResult{Entries: 1, Blobs: 1, Bytes: 3}, result)
+	require.False(t, client.Cache.hasBlob(entry.SHA256))
+	_, ok := client.Cache.lookup(server.URL + "/new")
+	require.True(t, ok)
+}
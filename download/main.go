@@ -0,0 +1,287 @@
+// Package download is the HTTP client shared by everything adapt fetches
+// itself (keys, release files, .deb files), with status checking,
+// timeouts and retries.
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	DEFAULT_TIMEOUT         = 10 * time.Minute
+	DEFAULT_CONNECT_TIMEOUT = 30 * time.Second
+	DEFAULT_MAX_RETRIES     = 3
+	DEFAULT_BACKOFF         = time.Second
+)
+
+// Returned for any response other than 200 OK
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: unexpected status %s", e.URL, e.Status)
+}
+
+// Whether err is a 404 response
+func IsNotFound(err error) bool {
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound
+}
+
+type Client struct {
+	HTTP *http.Client
+	// Where to keep downloaded keys and .deb files between runs, or nil
+	Cache *Cache
+	// How many times to retry after a connection error or 5xx response
+	MaxRetries int
+	// Delay before the first retry, doubled for each one after that
+	Backoff time.Duration
+
+	credentials []credentials
+}
+
+// Basic auth credentials for URLs under a prefix
+type credentials struct {
+	prefix   string
+	login    string
+	password string
+}
+
+// A client where each attempt is limited to timeout
+func NewClient(timeout time.Duration, maxRetries int) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: DEFAULT_CONNECT_TIMEOUT}).DialContext
+	return &Client{
+		HTTP:       &http.Client{Timeout: timeout, Transport: transport},
+		MaxRetries: maxRetries,
+		Backoff:    DEFAULT_BACKOFF,
+	}
+}
+
+// Send basic auth with requests for URLs under prefix. Like the "machine"
+// in apt's auth.conf, prefix is a host and optional path without a scheme,
+// e.g. "private-ppa.launchpadcontent.net/owner/name". Credentials are kept
+// out of URLs so they don't show up in errors or logs.
+func (c *Client) SetCredentials(prefix string, login string, password string) {
+	c.credentials = append(c.credentials, credentials{strings.TrimSuffix(prefix, "/"), login, password})
+}
+
+// The credentials with the longest prefix matching u, if any
+func (c *Client) credentialsFor(u *url.URL) *credentials {
+	target := u.Host + u.Path
+	var best *credentials
+	for i, cred := range c.credentials {
+		if target != cred.prefix && !strings.HasPrefix(target, cred.prefix+"/") {
+			continue
+		}
+		if best == nil || len(cred.prefix) > len(best.prefix) {
+			best = &c.credentials[i]
+		}
+	}
+	return best
+}
+
+// Send all requests through the given proxy instead of using the
+// HTTP_PROXY/HTTPS_PROXY environment variables
+func (c *Client) SetProxy(proxy string) error {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return fmt.Errorf("invalid proxy URL %s: %w", proxy, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid proxy URL %s: expected a scheme and host", proxy)
+	}
+	c.transport().Proxy = http.ProxyURL(u)
+	return nil
+}
+
+// Trust the PEM certificates in path in addition to the system roots,
+// e.g. for a corporate proxy's private CA
+func (c *Client) AddCAFile(path string) error {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	transport := c.transport()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	pool := transport.TLSClientConfig.RootCAs
+	if pool == nil {
+		pool, err = x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no PEM certificates found in %s", path)
+	}
+	transport.TLSClientConfig.RootCAs = pool
+	return nil
+}
+
+func (c *Client) transport() *http.Transport {
+	if t, ok := c.HTTP.Transport.(*http.Transport); ok {
+		return t
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	c.HTTP.Transport = t
+	return t
+}
+
+// Fetch url into memory
+func (c *Client) Get(ctx context.Context, url string) ([]byte, error) {
+	var buf bytes.Buffer
+	err := c.fetch(ctx, url, nil, func(resp *http.Response) error {
+		buf.Reset()
+		_, err := buf.ReadFrom(resp.Body)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Like Get, but reuses a cached copy if the client has a cache and the
+// server says it is still current
+func (c *Client) GetCached(ctx context.Context, url string) ([]byte, error) {
+	if c.Cache == nil {
+		return c.Get(ctx, url)
+	}
+	path, release, err := c.GetFile(ctx, url, "")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return os.ReadFile(path)
+}
+
+// Fetch url into a local file and return its path, along with a function
+// to call once the file is no longer needed. Without a cache this is a
+// temporary file. With a cache the file lives in the cache, and if
+// expectedSHA256 is given and already cached, no request is made at all.
+func (c *Client) GetFile(ctx context.Context, url string, expectedSHA256 string) (string, func(), error) {
+	if c.Cache != nil {
+		path, err := c.Cache.fetch(ctx, c, url, expectedSHA256)
+		return path, func() {}, err
+	}
+	tempFile, err := os.CreateTemp("", "adapt-download-*")
+	if err != nil {
+		return "", nil, err
+	}
+	err = c.fetch(ctx, url, nil, func(resp *http.Response) error {
+		return overwrite(tempFile, resp.Body, io.Discard)
+	})
+	if err2 := tempFile.Close(); err2 != nil && err == nil {
+		err = err2
+	}
+	release := func() {
+		if err2 := os.Remove(tempFile.Name()); err2 != nil {
+			log.Printf("Error cleaning up temp file: %v", err2)
+		}
+	}
+	if err != nil {
+		release()
+		return "", nil, err
+	}
+	return tempFile.Name(), release, nil
+}
+
+// Replace the contents of f with r, also copying it to w. Used to write
+// a download to a file, since a retry must start again from the beginning.
+func overwrite(f *os.File, r io.Reader, w io.Writer) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.Copy(io.MultiWriter(f, w), r)
+	return err
+}
+
+// Request url and pass the response to read, retrying with exponential
+// backoff when the request or read fails or the server returns a 5xx
+// status. Only 200 responses, or 304 to a conditional request, are read.
+// Cancelling ctx stops the download without further retries.
+func (c *Client) fetch(ctx context.Context, url string, header http.Header, read func(*http.Response) error) error {
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		err := c.attempt(ctx, url, header, read)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil || !retryable(err) || attempt >= c.MaxRetries {
+			return err
+		}
+		log.Printf("Retrying %s in %v (%d/%d): %v", url, backoff, attempt+1, c.MaxRetries, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, url string, header http.Header, read func(*http.Response) error) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if cred := c.credentialsFor(req.URL); cred != nil {
+		req.SetBasicAuth(cred.login, cred.password)
+	}
+	conditional := false
+	for k, v := range header {
+		req.Header[k] = v
+		conditional = conditional || k == "If-None-Match" || k == "If-Modified-Since"
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := resp.Body.Close(); err2 != nil {
+			log.Printf("Error closing response body: %v", err2)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK && !(conditional && resp.StatusCode == http.StatusNotModified) {
+		return &StatusError{URL: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return read(resp)
+}
+
+// Server errors and network failures are worth retrying; client errors,
+// bad URLs, certificate problems and local I/O errors are not.
+func retryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	// url.Error itself satisfies net.Error, so look at what it wraps
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
@@ -0,0 +1,202 @@
+package download
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestClient(server *httptest.Server, maxRetries int) *Client {
+	return &Client{HTTP: server.Client(), MaxRetries: maxRetries, Backoff: time.Millisecond}
+}
+
+// A server that fails with status for the first failures requests
+func newFlakyServer(failures int32, status int) (*httptest.Server, *atomic.Int32) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= failures {
+			http.Error(w, "try again", status)
+			return
+		}
+		_, _ = w.Write([]byte("payload"))
+	}))
+	return server, &requests
+}
+
+func TestGetRetriesServerErrors(t *testing.T) {
+	server, requests := newFlakyServer(2, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	body, err := newTestClient(server, 3).Get(context.Background(), server.URL)
+	require.NoError(t, err)
+	require.Equal(t, []byte("payload"), body)
+	require.Equal(t, int32(3), requests.Load())
+}
+
+func TestGetGivesUpAfterMaxRetries(t *testing.T) {
+	server, requests := newFlakyServer(10, http.StatusBadGateway)
+	defer server.Close()
+
+	_, err := newTestClient(server, 2).Get(context.Background(), server.URL)
+	var statusErr *StatusError
+	require.ErrorAs(t, err, &statusErr)
+	require.Equal(t, http.StatusBadGateway, statusErr.StatusCode)
+	require.Equal(t, int32(3), requests.Load())
+}
+
+func TestGetStopsRetryingWhenCancelled(t *testing.T) {
+	server, requests := newFlakyServer(10, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	client := newTestClient(server, 5)
+	client.Backoff = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for requests.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	_, err := client.Get(ctx, server.URL)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, int32(1), requests.Load())
+}
+
+func TestGetDoesNotRetryClientErrors(t *testing.T) {
+	server, requests := newFlakyServer(10, http.StatusNotFound)
+	defer server.Close()
+
+	_, err := newTestClient(server, 3).Get(context.Background(), server.URL)
+	require.True(t, IsNotFound(err))
+	require.Equal(t, int32(1), requests.Load())
+}
+
+func TestGetRetriesConnectionErrors(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	client := newTestClient(server, 2)
+	server.Close()
+
+	_, err := client.Get(context.Background(), url)
+	require.Error(t, err)
+	require.True(t, retryable(err))
+}
+
+func TestGetTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	client := newTestClient(server, 0)
+	client.HTTP.Timeout = 10 * time.Millisecond
+	_, err := client.Get(context.Background(), server.URL)
+	require.Error(t, err)
+	require.True(t, retryable(err))
+}
+
+func TestGetFile(t *testing.T) {
+	server, _ := newFlakyServer(1, http.StatusInternalServerError)
+	defer server.Close()
+
+	path, release, err := newTestClient(server, 1).GetFile(context.Background(), server.URL, "")
+	require.NoError(t, err)
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, []byte("payload"), content)
+	release()
+	require.NoFileExists(t, path)
+}
+
+func TestGetFileCleansUpOnError(t *testing.T) {
+	server, _ := newFlakyServer(10, http.StatusForbidden)
+	defer server.Close()
+
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	_, _, err := newTestClient(server, 1).GetFile(context.Background(), server.URL, "")
+	require.Error(t, err)
+	entries, err := os.ReadDir(tmp)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestSetProxy(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("via proxy for " + r.URL.Host))
+	}))
+	defer proxy.Close()
+
+	client := NewClient(time.Second, 0)
+	require.NoError(t, client.SetProxy(proxy.URL))
+	body, err := client.Get(context.Background(), "http://packages.example.invalid/key.asc")
+	require.NoError(t, err)
+	require.Equal(t, "via proxy for packages.example.invalid", string(body))
+
+	require.Error(t, client.SetProxy("proxy.internal:3128"))
+}
+
+func TestAddCAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("trusted"))
+	}))
+	defer server.Close()
+
+	client := NewClient(time.Second, 0)
+	_, err := client.Get(context.Background(), server.URL)
+	require.Error(t, err)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caFile, certPEM, 0644))
+	require.NoError(t, client.AddCAFile(caFile))
+	body, err := client.Get(context.Background(), server.URL)
+	require.NoError(t, err)
+	require.Equal(t, "trusted", string(body))
+
+	notPEM := filepath.Join(t.TempDir(), "empty.pem")
+	require.NoError(t, os.WriteFile(notPEM, []byte("nothing here"), 0644))
+	require.Error(t, client.AddCAFile(notPEM))
+}
+
+func TestGetSendsCredentialsForMatchingURLs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		login, password, ok := r.BasicAuth()
+		if !ok {
+			_, _ = w.Write([]byte("anonymous"))
+			return
+		}
+		_, _ = w.Write([]byte(login + ":" + password))
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	client := newTestClient(server, 0)
+	client.SetCredentials(host+"/private", "alice", "secret")
+	client.SetCredentials(host+"/private/team/", "team", "shared")
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/private", "alice:secret"},
+		{"/private/dists/InRelease", "alice:secret"},
+		{"/private/team/dists/InRelease", "team:shared"},
+		{"/privateer/dists/InRelease", "anonymous"},
+		{"/public/dists/InRelease", "anonymous"},
+	}
+	for _, tc := range tests {
+		body, err := client.Get(context.Background(), server.URL+tc.path)
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, string(body), tc.path)
+	}
+}
@@ -1,377 +1,226 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/ericsuh/adapt/aptfile"
-	"github.com/ericsuh/adapt/armor"
+	"github.com/ericsuh/adapt/download"
+	"github.com/ericsuh/adapt/runner"
 	"log"
-	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"os/user"
-	"regexp"
-	"slices"
+	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 )
 
-var ensuredAddAptRepository bool = false
-var needsUpdate bool = true
-
 func main() {
+	downloader := download.NewClient(download.DEFAULT_TIMEOUT, download.DEFAULT_MAX_RETRIES)
 	var dryRunFlag bool
 	var shortDryRunFlag bool
 
 	flag.BoolVar(&dryRunFlag, "dry-run", false, "show actions without making changes")
 	flag.BoolVar(&shortDryRunFlag, "n", false, "alias for --dry-run")
+	flag.IntVar(&downloader.MaxRetries, "max-retries", download.DEFAULT_MAX_RETRIES, "retries for failed downloads")
+	flag.DurationVar(&downloader.HTTP.Timeout, "timeout", download.DEFAULT_TIMEOUT, "time limit for each download attempt")
+	var network runner.NetworkConfig
+	flag.StringVar(&network.Proxy, "proxy", "", "HTTP proxy URL for adapt's own downloads")
+	flag.StringVar(&network.CAFile, "ca-file", "", "PEM file of extra CA certificates to trust for downloads")
+	flag.BoolVar(&network.ConfigureApt, "configure-apt", false, "also write the proxy and CA settings to apt.conf.d")
+	var cacheDir string
+	var cacheMaxAge time.Duration
+	flag.StringVar(&cacheDir, "cache-dir", download.DEFAULT_CACHE_DIR, "where to cache downloaded keys and .deb files (empty to disable)")
+	flag.DurationVar(&cacheMaxAge, "cache-max-age", 30*24*time.Hour, "for `cache prune`, remove files not used for this long")
+	var jobs int
+	flag.IntVar(&jobs, "jobs", runner.DEFAULT_JOBS, "number of downloads to run at once")
+	var root string
+	flag.StringVar(&root, "root", "", "install into the system at this directory (e.g. from debootstrap), using chroot")
 	flag.Parse()
 
 	dryRun := dryRunFlag || shortDryRunFlag
 
-	if !dryRun {
-		currentUser, err := user.Current()
-		if err != nil {
-			log.Fatal("Failed to get current user: ", err)
-		}
-		if currentUser.Uid != "0" {
-			log.Fatal("This program must be run as root. Please use sudo or run as root user.")
+	args := flag.Args()
+	command := ""
+	if len(args) > 0 && (args[0] == "lint" || args[0] == "explain-pins") {
+		command, args = args[0], args[1:]
+	} else if len(args) > 0 && args[0] == "cache" {
+		if len(args) != 2 || args[1] != "prune" || cacheDir == "" {
+			log.Fatal(USAGE)
 		}
+		pruneCache(cacheDir, cacheMaxAge)
+		return
 	}
 
 	var aptfilePath string
-	switch flag.NArg() {
+	switch len(args) {
 	case 0:
 		aptfilePath = "Aptfile"
 	case 1:
-		aptfilePath = flag.Arg(0)
+		aptfilePath = args[0]
 	default:
-		log.Fatal("Usage: adapt <Aptfile> or place Aptfile in current directory")
+		log.Fatal(USAGE)
 	}
 
 	if _, err := os.Stat(aptfilePath); os.IsNotExist(err) {
 		if aptfilePath == "Aptfile" {
-			log.Fatal("Usage: adapt <Aptfile> or place Aptfile in current directory")
+			log.Fatal(USAGE)
 		}
 		log.Fatalf("File %s not found", aptfilePath)
 	}
 
-	processAptfile(aptfilePath, dryRun)
-}
-
-func processAptfile(path string, dryRun bool) {
-	file, err := os.Open(path)
-	if err != nil {
-		log.Fatalf("Failed to open Aptfile: %v", err)
-	}
-	defer func() {
-		err2 := file.Close()
-		if err2 != nil {
-			log.Fatalf("Failed to close Aptfile: %v", err2)
+	if command == "lint" {
+		if warnings := aptfile.Lint(readAptfile(aptfilePath)); len(warnings) > 0 {
+			for _, w := range warnings {
+				fmt.Printf("%s: %s\n", aptfilePath, w)
+			}
+			os.Exit(1)
 		}
-	}()
-	dirs, err := aptfile.Parse(file)
-	if err != nil {
-		log.Fatalf("Failed to read Aptfile: %v", err)
+		return
 	}
 
-	pkgs := make([]aptfile.PackageDirective, 0)
-
-	// First pass, skip package installation (except for .deb files,
-	// which can be necessary for setting up repos or keyrings, etc.)
-	for _, d := range dirs {
-		switch dir := d.(type) {
-		case aptfile.PpaDirective:
-			if err := addPPA(dir.Name, dryRun); err != nil {
-				log.Fatalf("Failed to add PPA %s: %v", dir.Name, err)
-			} else {
-				needsUpdate = true
-			}
-		case aptfile.RepoDirective:
-			if err := addRepo(dir, dryRun); err != nil {
-				log.Fatalf("Failed to add repository: %v", err)
-			} else {
-				needsUpdate = true
-			}
-		case aptfile.PackageDirective:
-			pkgs = append(pkgs, dir)
-			// Don't install in this phase
-			continue
-		case aptfile.DebFileDirective:
-			if err := installDeb(dir.Path, dryRun); err != nil {
-				log.Fatalf("Failed to install deb %s: %v", dir.Path, err)
-			}
-		case aptfile.PinDirective:
-			if err := addPinPreference(dir, dryRun); err != nil {
-				log.Fatalf("Failed to add pin: %v", err)
-			}
-		case aptfile.HoldDirective:
-			if err := addHold(dir, dryRun); err != nil {
-				log.Fatalf("Failed to add hold: %v", err)
-			}
-		default:
-			log.Fatalf("Unknown directive: %v", d)
+	if root != "" {
+		if info, err := os.Stat(root); err != nil || !info.IsDir() {
+			log.Fatalf("Root %s is not a directory", root)
 		}
 	}
 
-	err = installPackages(pkgs, dryRun)
-	if err != nil {
-		log.Fatalf("Failed to install packages: %v", err)
+	if command == "explain-pins" {
+		explainPins(runner.New(runner.NewOSSystem(downloader, root)), aptfilePath)
+		return
 	}
-}
 
-func installPackages(pkgs []aptfile.PackageDirective, dryRun bool) error {
-	names := make([]string, len(pkgs))
-	for i, p := range pkgs {
-		if p.Version != "" {
-			names[i] = fmt.Sprintf("%s=%s", p.Name, p.Version)
-		} else if p.Release != "" {
-			names[i] = fmt.Sprintf("%s/%s", p.Name, p.Release)
-		} else {
-			names[i] = p.Name
-		}
-	}
-	if dryRun {
-		if needsUpdate {
-			fmt.Println("[dry-run] Would update package lists")
+	if !dryRun {
+		currentUser, err := user.Current()
+		if err != nil {
+			log.Fatal("Failed to get current user: ", err)
 		}
-		fmt.Printf("[dry-run] Would install packagess: %s\n", strings.Join(names, ", "))
-		return nil
-	}
-	if needsUpdate {
-		fmt.Printf("Updating package lists...\n")
-		cmd := exec.Command("apt-get", "update", "--yes")
-		cmd.Env = append(os.Environ(), "DEBIAN_FRONTEND=noninteractive")
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("error updating package lists: %w", err)
+		if currentUser.Uid != "0" {
+			log.Fatal("This program must be run as root. Please use sudo or run as root user.")
 		}
-		needsUpdate = false
 	}
-	fmt.Printf("Installing package: %s\n", strings.Join(names, ", "))
-	cmd := exec.Command("apt-get", slices.Concat([]string{"install", "--yes", "--no-install-recommends"}, names)...)
-	cmd.Env = append(os.Environ(), "DEBIAN_FRONTEND=noninteractive")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
-}
 
-func addPPA(ppa string, dryRun bool) error {
-	if !ensuredAddAptRepository {
-		if _, err := exec.LookPath("add-apt-repository"); err == nil {
-			ensuredAddAptRepository = true
-		} else if dryRun {
-			fmt.Println("[dry-run] Would install utility add-apt-repository (package software-properties-common)")
-			ensuredAddAptRepository = true
-		} else {
-			fmt.Println("Installing required utility add-apt-repository (package software-properties-common)")
-			err := installPackages([]aptfile.PackageDirective{{Name: "software-properties-common"}}, dryRun)
-			if err != nil {
-				return err
-			}
-			ensuredAddAptRepository = true
+	if cacheDir != "" && !dryRun {
+		cache, err := download.NewCache(cacheDir)
+		if err != nil {
+			log.Printf("Not caching downloads: %v", err)
 		}
+		downloader.Cache = cache
 	}
 
-	if dryRun {
-		fmt.Printf("[dry-run] Would add PPA: %s\n", ppa)
-		return nil
-	}
-
-	fmt.Printf("Adding PPA: %s\n", ppa)
-	cmd := exec.Command("add-apt-repository", "--yes", fmt.Sprintf("ppa:%s", ppa))
-	cmd.Env = append(os.Environ(), "DEBIAN_FRONTEND=noninteractive")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return err
-	}
-	return nil
+	r := runner.New(runner.NewOSSystem(downloader, root))
+	r.DryRun = dryRun
+	r.Network = network
+	r.Jobs = jobs
+	processAptfile(r, aptfilePath)
 }
 
-func installDeb(path string, dryRun bool) error {
-	var debFile string
+const USAGE = "Usage: adapt [lint|explain-pins] <Aptfile>, adapt cache prune, or place Aptfile in current directory"
 
-	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
-		if dryRun {
-			fmt.Printf("[dry-run] Would download .deb from: %s\n", path)
-			debFile = path
-		} else {
-			fmt.Printf("Downloading .deb from: %s\n", path)
-			tempFile, err := downloadFile(path)
-			if err != nil {
-				return err
-			}
-			defer func() {
-				err2 := os.Remove(tempFile)
-				if err2 != nil {
-					log.Printf("Error cleaning up temp file: %v", err2)
-				}
-			}()
-			debFile = tempFile
-		}
-	} else {
-		debFile = path
+func pruneCache(dir string, maxAge time.Duration) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return
 	}
-
-	if dryRun {
-		fmt.Printf("[dry-run] Would install .deb: %s\n", debFile)
-		return nil
+	cache, err := download.NewCache(dir)
+	if err != nil {
+		log.Fatalf("Failed to open cache: %v", err)
 	}
-
-	fmt.Printf("Installing .deb: %s\n", debFile)
-	cmd := exec.Command("dpkg", "-i", debFile)
-	cmd.Env = append(os.Environ(), "DEBIAN_FRONTEND=noninteractive")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	// Try with apt-get instead
-	if err := cmd.Run(); err != nil {
-		fixCmd := exec.Command("apt-get", "install", "-f", "-y")
-		fixCmd.Stdout = os.Stdout
-		fixCmd.Stderr = os.Stderr
-		err := fixCmd.Run()
-		if err != nil {
-			return err
-		}
+	result, err := cache.Prune(maxAge)
+	if err != nil {
+		log.Fatalf("Failed to prune cache: %v", err)
 	}
-	return nil
+	fmt.Printf("Removed %d cached URLs and %d files (%d bytes)\n", result.Entries, result.Blobs, result.Bytes)
 }
 
-func addRepo(d aptfile.RepoDirective, dryRun bool) error {
-	repoType := "deb"
-	if d.IsSrc {
-		repoType = "deb-src"
-	}
-
-	keyringPath := ""
-	if d.SignedBy != "" {
-		keyringPath = fmt.Sprintf("/usr/share/keyrings/%s.gpg", sanitizeFilename(d.URL))
-		if dryRun {
-			fmt.Printf("[dry-run] Would download GPG key from: %s\n", d.SignedBy)
-		} else {
-			fmt.Printf("Downloading GPG key from: %s\n", d.SignedBy)
-			if err := downloadGPGKey(d.SignedBy, keyringPath); err != nil {
-				return err
+// Say whether each pin in the Aptfile took effect, according to apt, and
+// exit non-zero if any didn't
+func explainPins(r *runner.Runner, path string) {
+	reports, err := r.ExplainPins(context.Background(), readAptfile(path))
+	if err != nil {
+		log.Fatal(err)
+	}
+	unmatched := 0
+	for _, report := range reports {
+		status := "matched"
+		if len(report.Packages) == 0 {
+			status = "no packages found"
+		} else if !report.Matched() {
+			status = "no versions matched"
+		}
+		if !report.Matched() {
+			unmatched += 1
+		}
+		fmt.Printf("%s, priority %d: %s\n", runner.Describe(report.Pin), report.Pin.Priority, status)
+		for _, pkg := range report.Packages {
+			candidate := pkg.Candidate
+			if candidate == "" {
+				candidate = "(none)"
+			}
+			if len(pkg.Pinned) > 0 {
+				fmt.Printf("  %s: pinned %s, candidate %s\n", pkg.Package, strings.Join(pkg.Pinned, ", "), candidate)
+			} else {
+				fmt.Printf("  %s: candidate %s\n", pkg.Package, candidate)
 			}
 		}
 	}
-
-	listFile := fmt.Sprintf("/etc/apt/sources.list.d/%s.list", sanitizeFilename(d.URL))
-	var sourceLine string
-	opts := make([]string, 0)
-	if d.Arch != "" {
-		opts = append(opts, fmt.Sprintf("arch=%s", d.Arch))
-	}
-	if keyringPath != "" {
-		opts = append(opts, fmt.Sprintf("signed-by=%s", keyringPath))
+	if unmatched > 0 {
+		os.Exit(1)
 	}
-	if len(opts) > 0 {
-		sourceLine = fmt.Sprintf("%s [%s] %s %s %s", repoType, strings.Join(opts, " "), d.URL, d.Suite, d.Component)
-	} else {
-		sourceLine = fmt.Sprintf("%s %s %s %s", repoType, d.URL, d.Suite, d.Component)
-	}
-	if dryRun {
-		fmt.Printf("[dry-run] Would add repository: %s\n", sourceLine)
-		return nil
-	}
-	return os.WriteFile(listFile, []byte(sourceLine), 0644)
 }
 
-func downloadFile(url string) (string, error) {
-	resp, err := http.Get(url)
-	if err != nil {
-		return "", err
-	}
-	defer func() {
-		err2 := resp.Body.Close()
-		if err2 != nil {
-			log.Printf("Error closing HTTP request: %v", err2)
-		}
-	}()
-
-	tempFile, err := os.CreateTemp("", "*.deb")
+func readAptfile(path string) []any {
+	file, err := os.Open(path)
 	if err != nil {
-		return "", err
+		log.Fatalf("Failed to open Aptfile: %v", err)
 	}
 	defer func() {
-		err2 := tempFile.Close()
+		err2 := file.Close()
 		if err2 != nil {
-			log.Printf("Error closing temp file: %v", err2)
+			log.Fatalf("Failed to close Aptfile: %v", err2)
 		}
 	}()
-
-	_, err = tempFile.ReadFrom(resp.Body)
+	dirs, err := aptfile.Parse(file)
 	if err != nil {
-		err2 := os.Remove(tempFile.Name())
-		if err2 != nil {
-			log.Printf("Error cleaning up temp file: %v", err2)
-		}
-		return "", err
+		log.Fatalf("Failed to read Aptfile: %v", err)
 	}
-
-	return tempFile.Name(), nil
+	return dirs
 }
 
-func downloadGPGKey(url, destPath string) error {
-	resp, err := http.Get(url)
-	if err != nil {
-		return err
-	}
+func processAptfile(r *runner.Runner, path string) {
+	dirs := readAptfile(path)
+	r.Dir = filepath.Dir(path)
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig, ok := <-signals
+		if !ok {
+			return
+		}
+		// A second signal stops adapt straight away
+		signal.Stop(signals)
+		log.Printf("Received %v, waiting for running commands to exit", sig)
+		cancel(&runner.SignalError{Signal: sig})
+	}()
 	defer func() {
-		if err2 := resp.Body.Close(); err2 != nil {
-			log.Printf("Error closing response body: %v", err2)
-		}
+		signal.Stop(signals)
+		close(signals)
 	}()
-	dearm, err := armor.Parse(resp.Body)
-	if err != nil {
-		return err
-	}
-	err = os.WriteFile(destPath, dearm, 0644)
-	return err
-}
-
-var okFileCharsRegex = regexp.MustCompile(`[^a-zA-Z0-9-_]+`)
-
-func sanitizeFilename(s string) string {
-	s = okFileCharsRegex.ReplaceAllString(s, "_")
-	s = strings.Trim(s, "_")
-	if len(s) > 50 {
-		s = s[:50]
-	}
-	return strings.ToLower(s)
-}
 
-func addPinPreference(pin aptfile.PinDirective, dryRun bool) error {
-	var pinValue string
-	if pin.Version != "" {
-		pinValue = fmt.Sprintf("version %s", pin.Version)
-	} else if pin.Release != "" {
-		pinValue = fmt.Sprintf("release %s", pin.Release)
-	} else if pin.Origin != "" {
-		pinValue = fmt.Sprintf("origin %s", pin.Origin)
-	}
-	basename := sanitizeFilename(pin.PackageName)
-	if len(basename) == 0 {
-		basename = sanitizeFilename(pinValue)
-	}
-	pinFile := fmt.Sprintf("/etc/apt/preferences.d/%s.pin", basename)
-	content := fmt.Sprintf("Package: %s\nPin-Priority: %d\nPin: %s\n", pin.PackageName, pin.Priority, pinValue)
-	if dryRun {
-		fmt.Printf("[dry-run] Would write pin file \"%s\"\n", pinFile)
-		return nil
-	} else {
-		return os.WriteFile(pinFile, []byte(content), 0644)
-	}
-}
-
-func addHold(hold aptfile.HoldDirective, dryRun bool) error {
-	if dryRun {
-		fmt.Printf("[dry-run] Would run `apt-mark hold %s`\n", hold.PackageName)
-		return nil
-	} else {
-		fixCmd := exec.Command("apt-mark", "hold", hold.PackageName)
-		fixCmd.Stdout = os.Stdout
-		fixCmd.Stderr = os.Stderr
-		return fixCmd.Run()
+	err := r.Apply(ctx, dirs)
+	var cancelled *runner.CancelledError
+	if errors.As(err, &cancelled) {
+		fmt.Printf("Stopped after completing %d of %d directives:\n", len(cancelled.Completed), cancelled.Total)
+		for _, d := range cancelled.Completed {
+			fmt.Printf("  %s\n", runner.Describe(d))
+		}
+		os.Exit(1)
+	} else if err != nil {
+		log.Fatal(err)
 	}
 }
@@ -0,0 +1,371 @@
+// Package pgp implements just enough of OpenPGP (RFC 4880 / RFC 9580)
+// to check repository signatures: reading public keys and verifying v4
+// RSA and Ed25519 signatures. It is not a general purpose OpenPGP
+// library; in particular it does not check key expiry, revocations, or
+// subkey binding signatures, all of which apt still checks itself.
+package pgp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+var (
+	ErrPacketParse          = errors.New("error parsing OpenPGP packet")
+	ErrUnsupportedAlgorithm = errors.New("unsupported public key algorithm")
+	ErrUnsupportedVersion   = errors.New("unsupported OpenPGP version")
+)
+
+// Whether err means a key or signature uses a version or algorithm that
+// can't be checked here, rather than that it is malformed or wrong. apt
+// may well be able to check it.
+func IsUnsupported(err error) bool {
+	return errors.Is(err, ErrUnsupportedAlgorithm) || errors.Is(err, ErrUnsupportedVersion)
+}
+
+const (
+	PACKET_TAG_SIGNATURE     uint8 = 2
+	PACKET_TAG_SECRET_KEY    uint8 = 5
+	PACKET_TAG_PUBLIC_KEY    uint8 = 6
+	PACKET_TAG_SECRET_SUBKEY uint8 = 7
+	PACKET_TAG_USER_ID       uint8 = 13
+	PACKET_TAG_PUBLIC_SUBKEY uint8 = 14
+)
+
+const (
+	ALGO_RSA              uint8 = 1
+	ALGO_RSA_ENCRYPT_ONLY uint8 = 2
+	ALGO_RSA_SIGN_ONLY    uint8 = 3
+	ALGO_EDDSA_LEGACY     uint8 = 22
+	ALGO_ED25519          uint8 = 27
+)
+
+const (
+	ED25519_LEGACY_OID          = "\x2b\x06\x01\x04\x01\xda\x47\x0f\x01"
+	ED25519_NATIVE_POINT_PREFIX = 0x40
+)
+
+type packet struct {
+	Tag  uint8
+	Body []byte
+	// The packet as it appeared in the data, header included
+	Raw []byte
+}
+
+// Split a binary OpenPGP message into its packets. Both the old and
+// new packet header formats are accepted, including partial body lengths.
+func readPackets(data []byte) ([]packet, error) {
+	packets := make([]packet, 0)
+	for len(data) > 0 {
+		start := data
+		hdr := data[0]
+		data = data[1:]
+		if hdr&0x80 == 0 {
+			return nil, fmt.Errorf("%w: invalid packet header 0x%02x", ErrPacketParse, hdr)
+		}
+		var p packet
+		if hdr&0x40 != 0 {
+			p.Tag = hdr & 0x3f
+			for {
+				length, partial, rest, err := readNewLength(data)
+				if err != nil {
+					return nil, err
+				}
+				if length > len(rest) {
+					return nil, fmt.Errorf("%w: packet length %d exceeds remaining data", ErrPacketParse, length)
+				}
+				p.Body = append(p.Body, rest[:length]...)
+				data = rest[length:]
+				if !partial {
+					break
+				}
+			}
+		} else {
+			p.Tag = (hdr >> 2) & 0x0f
+			var length int
+			switch hdr & 0x03 {
+			case 0:
+				if len(data) < 1 {
+					return nil, fmt.Errorf("%w: truncated packet length", ErrPacketParse)
+				}
+				length, data = int(data[0]), data[1:]
+			case 1:
+				if len(data) < 2 {
+					return nil, fmt.Errorf("%w: truncated packet length", ErrPacketParse)
+				}
+				length, data = int(binary.BigEndian.Uint16(data)), data[2:]
+			case 2:
+				if len(data) < 4 {
+					return nil, fmt.Errorf("%w: truncated packet length", ErrPacketParse)
+				}
+				length, data = int(binary.BigEndian.Uint32(data)), data[4:]
+			case 3:
+				// Indeterminate length, extends to the end of the data
+				length = len(data)
+			}
+			if length > len(data) {
+				return nil, fmt.Errorf("%w: packet length %d exceeds remaining data", ErrPacketParse, length)
+			}
+			p.Body, data = data[:length], data[length:]
+		}
+		p.Raw = start[:len(start)-len(data)]
+		packets = append(packets, p)
+	}
+	return packets, nil
+}
+
+// Read a new-format packet length, returning the length, whether it is
+// a partial body length, and the remaining data.
+func readNewLength(data []byte) (int, bool, []byte, error) {
+	if len(data) < 1 {
+		return 0, false, nil, fmt.Errorf("%w: truncated packet length", ErrPacketParse)
+	}
+	o1 := int(data[0])
+	switch {
+	case o1 < 192:
+		return o1, false, data[1:], nil
+	case o1 < 224:
+		if len(data) < 2 {
+			return 0, false, nil, fmt.Errorf("%w: truncated packet length", ErrPacketParse)
+		}
+		return ((o1 - 192) << 8) + int(data[1]) + 192, false, data[2:], nil
+	case o1 == 255:
+		if len(data) < 5 {
+			return 0, false, nil, fmt.Errorf("%w: truncated packet length", ErrPacketParse)
+		}
+		return int(binary.BigEndian.Uint32(data[1:5])), false, data[5:], nil
+	default:
+		return 1 << (o1 & 0x1f), true, data[1:], nil
+	}
+}
+
+// Read a multiprecision integer, returning its big-endian bytes
+// and the remaining data
+func readMPI(data []byte) ([]byte, []byte, error) {
+	if len(data) < 2 {
+		return nil, nil, fmt.Errorf("%w: truncated MPI", ErrPacketParse)
+	}
+	bits := int(binary.BigEndian.Uint16(data))
+	n := (bits + 7) / 8
+	if len(data) < 2+n {
+		return nil, nil, fmt.Errorf("%w: truncated MPI", ErrPacketParse)
+	}
+	return data[2 : 2+n], data[2+n:], nil
+}
+
+// A public key or subkey that can verify signatures
+type Key struct {
+	Fingerprint []byte
+	KeyID       uint64
+	Algorithm   uint8
+	IsSubkey    bool
+	// The first user ID of the certificate this key belongs to, if any
+	UserID string
+
+	rsa     *rsa.PublicKey
+	ed25519 ed25519.PublicKey
+}
+
+// The fingerprint as uppercase hex, as shown by `gpg --fingerprint`
+func (k *Key) FingerprintString() string {
+	return strings.ToUpper(hex.EncodeToString(k.Fingerprint))
+}
+
+func (k *Key) KeyIDString() string {
+	return FormatKeyID(k.KeyID)
+}
+
+func FormatKeyID(id uint64) string {
+	return fmt.Sprintf("%016X", id)
+}
+
+// All keys and subkeys found in a binary keyring
+type Keyring []*Key
+
+// Parse a binary keyring, such as the output of `gpg --export` or a
+// de-armored public key block. Keys using algorithms that cannot sign,
+// or that are not supported here, are still listed so that they can be
+// reported by fingerprint, but cannot verify signatures. Keys of versions
+// other than 4 are skipped, and if there are no others the error is
+// ErrUnsupportedVersion.
+func ReadKeyring(data []byte) (Keyring, error) {
+	packets, err := readPackets(data)
+	if err != nil {
+		return nil, err
+	}
+	keyring := make(Keyring, 0)
+	var userID string
+	var certKeys []*Key
+	var unsupported error
+	for _, p := range packets {
+		switch p.Tag {
+		case PACKET_TAG_PUBLIC_KEY, PACKET_TAG_PUBLIC_SUBKEY:
+			key, err := parsePublicKey(p.Body)
+			if errors.Is(err, ErrUnsupportedVersion) {
+				unsupported = err
+				if p.Tag == PACKET_TAG_PUBLIC_KEY {
+					userID = ""
+					certKeys = nil
+				}
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			key.IsSubkey = p.Tag == PACKET_TAG_PUBLIC_SUBKEY
+			if !key.IsSubkey {
+				userID = ""
+				certKeys = nil
+			}
+			key.UserID = userID
+			certKeys = append(certKeys, key)
+			keyring = append(keyring, key)
+		case PACKET_TAG_USER_ID:
+			if userID == "" {
+				userID = string(p.Body)
+				for _, k := range certKeys {
+					k.UserID = userID
+				}
+			}
+		}
+	}
+	if len(keyring) == 0 {
+		if unsupported != nil {
+			return nil, unsupported
+		}
+		return nil, fmt.Errorf("%w: no public keys found", ErrPacketParse)
+	}
+	return keyring, nil
+}
+
+// Extract from a binary keyring the certificate containing the key with
+// the given fingerprint: its primary key, user IDs, subkeys and their
+// signatures, exactly as they appeared. Every other certificate is left
+// out, so that a keyring fetched from a keyserver can't carry extra keys
+// along with the one asked for.
+func Certificate(data []byte, fpr string) ([]byte, error) {
+	packets, err := readPackets(data)
+	if err != nil {
+		return nil, err
+	}
+	fpr = NormalizeFingerprint(fpr)
+	var cert []byte
+	var found bool
+	for _, p := range packets {
+		if p.Tag == PACKET_TAG_PUBLIC_KEY {
+			if found {
+				break
+			}
+			cert = nil
+		}
+		cert = append(cert, p.Raw...)
+		if p.Tag != PACKET_TAG_PUBLIC_KEY && p.Tag != PACKET_TAG_PUBLIC_SUBKEY {
+			continue
+		}
+		key, err := parsePublicKey(p.Body)
+		if errors.Is(err, ErrUnsupportedVersion) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if key.FingerprintString() == fpr {
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: no key with fingerprint %s", ErrPacketParse, fpr)
+	}
+	return cert, nil
+}
+
+// Find the key with the given key ID, or nil
+func (kr Keyring) ByKeyID(id uint64) *Key {
+	for _, k := range kr {
+		if k.KeyID == id {
+			return k
+		}
+	}
+	return nil
+}
+
+// Find the key with the given fingerprint, or nil. The fingerprint
+// may contain spaces and is matched case-insensitively.
+func (kr Keyring) ByFingerprint(fpr string) *Key {
+	fpr = NormalizeFingerprint(fpr)
+	for _, k := range kr {
+		if k.FingerprintString() == fpr {
+			return k
+		}
+	}
+	return nil
+}
+
+// Remove spaces and any "0x" prefix and uppercase a fingerprint
+func NormalizeFingerprint(fpr string) string {
+	fpr = strings.ReplaceAll(fpr, " ", "")
+	fpr = strings.TrimPrefix(strings.TrimPrefix(fpr, "0x"), "0X")
+	return strings.ToUpper(fpr)
+}
+
+func parsePublicKey(body []byte) (*Key, error) {
+	if len(body) < 6 {
+		return nil, fmt.Errorf("%w: truncated public key", ErrPacketParse)
+	}
+	if body[0] != 4 {
+		return nil, fmt.Errorf("%w: public key version %d", ErrUnsupportedVersion, body[0])
+	}
+	var hashed bytes.Buffer
+	hashed.WriteByte(0x99)
+	_ = binary.Write(&hashed, binary.BigEndian, uint16(len(body)))
+	hashed.Write(body)
+	fpr := sha1.Sum(hashed.Bytes())
+	key := &Key{
+		Fingerprint: fpr[:],
+		KeyID:       binary.BigEndian.Uint64(fpr[12:20]),
+		Algorithm:   body[5],
+	}
+	material := body[6:]
+	switch key.Algorithm {
+	case ALGO_RSA, ALGO_RSA_SIGN_ONLY, ALGO_RSA_ENCRYPT_ONLY:
+		n, rest, err := readMPI(material)
+		if err != nil {
+			return nil, err
+		}
+		e, _, err := readMPI(rest)
+		if err != nil {
+			return nil, err
+		}
+		if len(e) > 4 {
+			return nil, fmt.Errorf("%w: RSA exponent too large", ErrPacketParse)
+		}
+		key.rsa = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	case ALGO_EDDSA_LEGACY:
+		if len(material) < 1 || len(material) < 1+int(material[0]) {
+			return nil, fmt.Errorf("%w: truncated curve OID", ErrPacketParse)
+		}
+		oid := material[1 : 1+int(material[0])]
+		point, _, err := readMPI(material[1+int(material[0]):])
+		if err != nil {
+			return nil, err
+		}
+		if string(oid) == ED25519_LEGACY_OID && len(point) == ed25519.PublicKeySize+1 && point[0] == ED25519_NATIVE_POINT_PREFIX {
+			key.ed25519 = ed25519.PublicKey(point[1:])
+		}
+	case ALGO_ED25519:
+		if len(material) < ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%w: truncated Ed25519 key", ErrPacketParse)
+		}
+		key.ed25519 = ed25519.PublicKey(material[:ed25519.PublicKeySize])
+	}
+	return key, nil
+}
@@ -0,0 +1,124 @@
+package pgp
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ericsuh/adapt/armor"
+	"github.com/stretchr/testify/require"
+)
+
+func readTestKeyring(t *testing.T, name string) Keyring {
+	t.Helper()
+	content, err := os.ReadFile(filepath.Join("..", "test_data", name))
+	require.NoError(t, err)
+	block, err := armor.Parse(bytes.NewReader(content))
+	require.NoError(t, err)
+	keyring, err := ReadKeyring(block.Body)
+	require.NoError(t, err)
+	return keyring
+}
+
+func TestReadKeyring(t *testing.T) {
+	tests := []struct {
+		file         string
+		fingerprints []string
+		userID       string
+	}{
+		{
+			file: "alice_cert.asc",
+			fingerprints: []string{
+				"EB85BB5FA33A75E15E944E63F231550C4F47E38E",
+				"EA02B24FFD4C1B96616D3DF24766F6B9D5F21EB6",
+			},
+			userID: "Alice Lovelace <alice@openpgp.example>",
+		},
+		{
+			file: "bob_cert.asc",
+			fingerprints: []string{
+				"D1A66E1A23B182C9980F788CFBFCC82A015E7330",
+				"1DDCE15F09217CEE2F3B37607C2FAA4DF93C37B2",
+			},
+			userID: "Bob Babbage <bob@openpgp.example>",
+		},
+		{
+			file: "key.gpg.asc",
+			fingerprints: []string{
+				"9DC858229FC7DD38854AE2D88D81803C0EBFCD88",
+				"D3306A018370199E527AE7997EA0A9C3F273FCD8",
+			},
+			userID: "Docker Release (CE deb) <docker@docker.com>",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.file, func(t *testing.T) {
+			keyring := readTestKeyring(t, tc.file)
+			require.Len(t, keyring, len(tc.fingerprints))
+			for i, fpr := range tc.fingerprints {
+				require.Equal(t, fpr, keyring[i].FingerprintString())
+				require.Equal(t, i > 0, keyring[i].IsSubkey)
+				require.Equal(t, tc.userID, keyring[i].UserID)
+			}
+		})
+	}
+}
+
+func TestKeyringLookup(t *testing.T) {
+	keyring := readTestKeyring(t, "bob_cert.asc")
+	require.NotNil(t, keyring.ByFingerprint("d1a6 6e1a 23b1 82c9 980f  788c fbfc c82a 015e 7330"))
+	require.NotNil(t, keyring.ByFingerprint("0xD1A66E1A23B182C9980F788CFBFCC82A015E7330"))
+	require.Nil(t, keyring.ByFingerprint("EB85BB5FA33A75E15E944E63F231550C4F47E38E"))
+	require.Equal(t, "FBFCC82A015E7330", keyring.ByKeyID(0xFBFCC82A015E7330).KeyIDString())
+}
+
+func TestReadKeyringRejectsGarbage(t *testing.T) {
+	_, err := ReadKeyring([]byte("<html>Not Found</html>"))
+	require.ErrorIs(t, err, ErrPacketParse)
+}
+
+func TestReadKeyringUnsupportedVersion(t *testing.T) {
+	// A v6 public key packet on its own
+	v6 := []byte{0xc6, 0x06, 6, 0x00, 0x00, 0x00, 0x00, 27}
+	_, err := ReadKeyring(v6)
+	require.ErrorIs(t, err, ErrUnsupportedVersion)
+	require.True(t, IsUnsupported(err))
+
+	// and alongside a v4 key, which is still read
+	content, err := os.ReadFile(filepath.Join("..", "test_data", "bob_cert.asc"))
+	require.NoError(t, err)
+	block, err := armor.Parse(bytes.NewReader(content))
+	require.NoError(t, err)
+	keyring, err := ReadKeyring(append(append([]byte{}, v6...), block.Body...))
+	require.NoError(t, err)
+	require.NotNil(t, keyring.ByKeyID(0xFBFCC82A015E7330))
+}
+
+func TestCertificate(t *testing.T) {
+	var keyring, alice, bob []byte
+	for _, f := range []string{"alice_cert.asc", "bob_cert.asc"} {
+		content, err := os.ReadFile(filepath.Join("..", "test_data", f))
+		require.NoError(t, err)
+		block, err := armor.Parse(bytes.NewReader(content))
+		require.NoError(t, err)
+		keyring = append(keyring, block.Body...)
+		if f == "alice_cert.asc" {
+			alice = block.Body
+		} else {
+			bob = block.Body
+		}
+	}
+
+	cert, err := Certificate(keyring, "eb85 bb5f a33a 75e1 5e94 4e63 f231 550c 4f47 e38e")
+	require.NoError(t, err)
+	require.Equal(t, alice, cert)
+	cert, err = Certificate(keyring, "D1A66E1A23B182C9980F788CFBFCC82A015E7330")
+	require.NoError(t, err)
+	require.Equal(t, bob, cert)
+
+	_, err = Certificate(keyring, strings.Repeat("A", 40))
+	require.ErrorIs(t, err, ErrPacketParse)
+}
@@ -0,0 +1,318 @@
+package pgp
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ericsuh/adapt/armor"
+)
+
+var (
+	ErrUnknownSigner = errors.New("signature was not made by any key in the keyring")
+	ErrBadSignature  = errors.New("signature verification failed")
+	ErrNoSignature   = errors.New("no signatures found")
+)
+
+const (
+	SIG_TYPE_BINARY uint8 = 0x00
+	SIG_TYPE_TEXT   uint8 = 0x01
+)
+
+const (
+	SUBPACKET_ISSUER             uint8 = 16
+	SUBPACKET_ISSUER_FINGERPRINT uint8 = 33
+)
+
+var hashAlgorithms = map[uint8]crypto.Hash{
+	8:  crypto.SHA256,
+	9:  crypto.SHA384,
+	10: crypto.SHA512,
+	11: crypto.SHA224,
+}
+
+// A parsed v4 signature packet
+type Signature struct {
+	SigType           uint8
+	PubKeyAlgo        uint8
+	Hash              crypto.Hash
+	IssuerKeyID       uint64
+	IssuerFingerprint []byte
+
+	hashAlgo   uint8
+	hashed     []byte
+	hashLeft   [2]byte
+	rsaSig     []byte
+	ed25519Sig []byte
+}
+
+// The issuer as a key ID, falling back to the fingerprint when the
+// signature only carries an issuer fingerprint subpacket.
+func (s *Signature) Issuer() string {
+	if s.IssuerKeyID != 0 {
+		return FormatKeyID(s.IssuerKeyID)
+	}
+	if len(s.IssuerFingerprint) >= 8 {
+		return FormatKeyID(binary.BigEndian.Uint64(s.IssuerFingerprint[len(s.IssuerFingerprint)-8:]))
+	}
+	return "unknown"
+}
+
+// Parse every signature packet in a binary signature, e.g. the body
+// of an armored "PGP SIGNATURE" block. Signatures of versions other than 4
+// are skipped, and if there are no others the error is
+// ErrUnsupportedVersion.
+func ReadSignatures(data []byte) ([]*Signature, error) {
+	packets, err := readPackets(data)
+	if err != nil {
+		return nil, err
+	}
+	sigs := make([]*Signature, 0)
+	var unsupported error
+	for _, p := range packets {
+		if p.Tag != PACKET_TAG_SIGNATURE {
+			continue
+		}
+		sig, err := parseSignature(p.Body)
+		if errors.Is(err, ErrUnsupportedVersion) {
+			unsupported = err
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, sig)
+	}
+	if len(sigs) == 0 {
+		if unsupported != nil {
+			return nil, unsupported
+		}
+		return nil, ErrNoSignature
+	}
+	return sigs, nil
+}
+
+func parseSignature(body []byte) (*Signature, error) {
+	if len(body) < 6 {
+		return nil, fmt.Errorf("%w: truncated signature", ErrPacketParse)
+	}
+	if body[0] != 4 {
+		return nil, fmt.Errorf("%w: signature version %d", ErrUnsupportedVersion, body[0])
+	}
+	sig := &Signature{
+		SigType:    body[1],
+		PubKeyAlgo: body[2],
+		hashAlgo:   body[3],
+	}
+	hashedLen := int(binary.BigEndian.Uint16(body[4:6]))
+	if len(body) < 6+hashedLen+2 {
+		return nil, fmt.Errorf("%w: truncated signature", ErrPacketParse)
+	}
+	sig.hashed = body[:6+hashedLen]
+	rest := body[6+hashedLen:]
+	unhashedLen := int(binary.BigEndian.Uint16(rest))
+	if len(rest) < 2+unhashedLen+2 {
+		return nil, fmt.Errorf("%w: truncated signature", ErrPacketParse)
+	}
+	if err := sig.parseSubpackets(body[6 : 6+hashedLen]); err != nil {
+		return nil, err
+	}
+	if err := sig.parseSubpackets(rest[2 : 2+unhashedLen]); err != nil {
+		return nil, err
+	}
+	rest = rest[2+unhashedLen:]
+	copy(sig.hashLeft[:], rest[:2])
+	rest = rest[2:]
+
+	sig.Hash = hashAlgorithms[sig.hashAlgo]
+	switch sig.PubKeyAlgo {
+	case ALGO_RSA, ALGO_RSA_SIGN_ONLY:
+		s, _, err := readMPI(rest)
+		if err != nil {
+			return nil, err
+		}
+		sig.rsaSig = s
+	case ALGO_EDDSA_LEGACY:
+		r, rest, err := readMPI(rest)
+		if err != nil {
+			return nil, err
+		}
+		s, _, err := readMPI(rest)
+		if err != nil {
+			return nil, err
+		}
+		if len(r) > 32 || len(s) > 32 {
+			return nil, fmt.Errorf("%w: EdDSA signature too large", ErrPacketParse)
+		}
+		// MPIs drop leading zeros, so pad each half back out
+		sig.ed25519Sig = make([]byte, ed25519.SignatureSize)
+		copy(sig.ed25519Sig[32-len(r):32], r)
+		copy(sig.ed25519Sig[64-len(s):], s)
+	case ALGO_ED25519:
+		if len(rest) < ed25519.SignatureSize {
+			return nil, fmt.Errorf("%w: truncated Ed25519 signature", ErrPacketParse)
+		}
+		sig.ed25519Sig = rest[:ed25519.SignatureSize]
+	}
+	return sig, nil
+}
+
+func (s *Signature) parseSubpackets(data []byte) error {
+	for len(data) > 0 {
+		var length int
+		o1 := int(data[0])
+		switch {
+		case o1 < 192:
+			length, data = o1, data[1:]
+		case o1 < 255:
+			if len(data) < 2 {
+				return fmt.Errorf("%w: truncated subpacket", ErrPacketParse)
+			}
+			length, data = ((o1-192)<<8)+int(data[1])+192, data[2:]
+		default:
+			if len(data) < 5 {
+				return fmt.Errorf("%w: truncated subpacket", ErrPacketParse)
+			}
+			length, data = int(binary.BigEndian.Uint32(data[1:5])), data[5:]
+		}
+		if length < 1 || length > len(data) {
+			return fmt.Errorf("%w: bad subpacket length %d", ErrPacketParse, length)
+		}
+		subType, content := data[0]&0x7f, data[1:length]
+		data = data[length:]
+		switch subType {
+		case SUBPACKET_ISSUER:
+			if len(content) == 8 {
+				s.IssuerKeyID = binary.BigEndian.Uint64(content)
+			}
+		case SUBPACKET_ISSUER_FINGERPRINT:
+			if len(content) > 1 {
+				s.IssuerFingerprint = content[1:]
+			}
+		}
+	}
+	return nil
+}
+
+// Check the signature over data with the given key
+func (s *Signature) Verify(key *Key, data []byte) error {
+	if !s.Hash.Available() {
+		return fmt.Errorf("%w: hash algorithm %d", ErrUnsupportedAlgorithm, s.hashAlgo)
+	}
+	h := s.Hash.New()
+	h.Write(data)
+	h.Write(s.hashed)
+	var trailer [6]byte
+	trailer[0] = 4
+	trailer[1] = 0xff
+	binary.BigEndian.PutUint32(trailer[2:], uint32(len(s.hashed)))
+	h.Write(trailer[:])
+	digest := h.Sum(nil)
+	if digest[0] != s.hashLeft[0] || digest[1] != s.hashLeft[1] {
+		return ErrBadSignature
+	}
+
+	switch {
+	case key.rsa != nil && s.rsaSig != nil:
+		// The signature must be padded out to the size of the modulus
+		padded := make([]byte, key.rsa.Size())
+		if len(s.rsaSig) > len(padded) {
+			return ErrBadSignature
+		}
+		copy(padded[len(padded)-len(s.rsaSig):], s.rsaSig)
+		if err := rsa.VerifyPKCS1v15(key.rsa, s.Hash, digest, padded); err != nil {
+			return fmt.Errorf("%w: %v", ErrBadSignature, err)
+		}
+		return nil
+	case key.ed25519 != nil && s.ed25519Sig != nil:
+		if !ed25519.Verify(key.ed25519, digest, s.ed25519Sig) {
+			return ErrBadSignature
+		}
+		return nil
+	case key.Algorithm != s.PubKeyAlgo:
+		return fmt.Errorf("%w: signature algorithm %d does not match key algorithm %d", ErrBadSignature, s.PubKeyAlgo, key.Algorithm)
+	default:
+		return fmt.Errorf("%w: %d", ErrUnsupportedAlgorithm, s.PubKeyAlgo)
+	}
+}
+
+// Find the key that made the signature, if it is in the keyring
+func (kr Keyring) signer(s *Signature) *Key {
+	if len(s.IssuerFingerprint) > 0 {
+		for _, k := range kr {
+			if string(k.Fingerprint) == string(s.IssuerFingerprint) {
+				return k
+			}
+		}
+	}
+	if s.IssuerKeyID != 0 {
+		return kr.ByKeyID(s.IssuerKeyID)
+	}
+	return nil
+}
+
+// Verify a detached signature over data. Succeeds if any of the
+// signatures was made by a key in the keyring and is valid, and returns
+// that key. If none is but a signature by a key in the keyring can't be
+// checked here, the error satisfies IsUnsupported, unless another
+// signature by a key in the keyring is bad.
+func (kr Keyring) VerifyDetached(data []byte, signature []byte) (*Key, error) {
+	sigs, err := ReadSignatures(signature)
+	if err != nil {
+		return nil, err
+	}
+	issuers := make([]string, 0, len(sigs))
+	var verifyErr, unsupported error
+	for _, sig := range sigs {
+		key := kr.signer(sig)
+		if key == nil {
+			issuers = append(issuers, sig.Issuer())
+			continue
+		}
+		signed := data
+		if sig.SigType == SIG_TYPE_TEXT {
+			signed = canonicalText(data)
+		}
+		if err := sig.Verify(key, signed); IsUnsupported(err) {
+			unsupported = fmt.Errorf("key %s: %w", key.KeyIDString(), err)
+			continue
+		} else if err != nil {
+			verifyErr = fmt.Errorf("key %s: %w", key.KeyIDString(), err)
+			continue
+		}
+		return key, nil
+	}
+	if verifyErr != nil {
+		return nil, verifyErr
+	}
+	if unsupported != nil {
+		return nil, unsupported
+	}
+	return nil, fmt.Errorf("%w: signed by key %s", ErrUnknownSigner, strings.Join(issuers, ", "))
+}
+
+// Verify a cleartext-signed message such as an InRelease file
+func (kr Keyring) VerifyCleartext(msg *armor.SignedMessage) (*Key, error) {
+	return kr.VerifyDetached(cleartextSignedData(msg.Text), msg.Signature.Body)
+}
+
+// The cleartext framework ignores trailing whitespace on each line, and
+// the text is always signed in canonical form with CRLF line endings.
+func cleartextSignedData(text []byte) []byte {
+	lines := strings.Split(string(text), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, " \t\r")
+	}
+	return []byte(strings.Join(lines, "\r\n"))
+}
+
+// Convert line endings to CRLF, as is done for text signatures
+func canonicalText(data []byte) []byte {
+	s := strings.ReplaceAll(string(data), "\r\n", "\n")
+	return []byte(strings.ReplaceAll(s, "\n", "\r\n"))
+}
@@ -0,0 +1,105 @@
+package pgp
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ericsuh/adapt/armor"
+	"github.com/stretchr/testify/require"
+)
+
+func readTestInRelease(t *testing.T, repo string) *armor.SignedMessage {
+	t.Helper()
+	content, err := os.ReadFile(filepath.Join("..", "test_data", "repos", repo, "dists", "stable", "InRelease"))
+	require.NoError(t, err)
+	msg, err := armor.ParseCleartext(bytes.NewReader(content))
+	require.NoError(t, err)
+	return msg
+}
+
+func TestVerifyCleartext(t *testing.T) {
+	tests := []struct {
+		repo    string
+		keyFile string
+		signer  string
+	}{
+		{repo: "alice", keyFile: "alice_cert.asc", signer: "F231550C4F47E38E"},
+		{repo: "bob", keyFile: "bob_cert.asc", signer: "FBFCC82A015E7330"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.repo, func(t *testing.T) {
+			keyring := readTestKeyring(t, tc.keyFile)
+			key, err := keyring.VerifyCleartext(readTestInRelease(t, tc.repo))
+			require.NoError(t, err)
+			require.Equal(t, tc.signer, key.KeyIDString())
+		})
+	}
+}
+
+func TestVerifyCleartextWrongKey(t *testing.T) {
+	keyring := readTestKeyring(t, "key.gpg.asc")
+	_, err := keyring.VerifyCleartext(readTestInRelease(t, "bob"))
+	require.ErrorIs(t, err, ErrUnknownSigner)
+	require.ErrorContains(t, err, "FBFCC82A015E7330")
+}
+
+func TestVerifyCleartextTampered(t *testing.T) {
+	for _, repo := range []string{"alice", "bob"} {
+		t.Run(repo, func(t *testing.T) {
+			keyring := readTestKeyring(t, repo+"_cert.asc")
+			msg := readTestInRelease(t, repo)
+			msg.Text = bytes.Replace(msg.Text, []byte("amd64 arm64"), []byte("amd64 i386"), 1)
+			_, err := keyring.VerifyCleartext(msg)
+			require.ErrorIs(t, err, ErrBadSignature)
+		})
+	}
+}
+
+func TestVerifyCleartextIgnoresTrailingWhitespace(t *testing.T) {
+	keyring := readTestKeyring(t, "alice_cert.asc")
+	msg := readTestInRelease(t, "alice")
+	msg.Text = bytes.Replace(msg.Text, []byte("Suite: stable\n"), []byte("Suite: stable \t\n"), 1)
+	_, err := keyring.VerifyCleartext(msg)
+	require.NoError(t, err)
+}
+
+func TestVerifyDetached(t *testing.T) {
+	dir := filepath.Join("..", "test_data", "repos", "detached", "dists", "stable")
+	data, err := os.ReadFile(filepath.Join(dir, "Release"))
+	require.NoError(t, err)
+	sig, err := os.ReadFile(filepath.Join(dir, "Release.gpg"))
+	require.NoError(t, err)
+
+	key, err := readTestKeyring(t, "bob_cert.asc").VerifyDetached(data, sig)
+	require.NoError(t, err)
+	require.Equal(t, "FBFCC82A015E7330", key.KeyIDString())
+
+	_, err = readTestKeyring(t, "bob_cert.asc").VerifyDetached(append(data, '\n'), sig)
+	require.ErrorIs(t, err, ErrBadSignature)
+}
+
+func TestVerifyCleartextUnsupportedAlgorithm(t *testing.T) {
+	// carol's key is ECDSA P-256, which is read but can't be checked here
+	keyring := readTestKeyring(t, "carol_cert.asc")
+	require.Equal(t, uint8(19), keyring[0].Algorithm)
+	_, err := keyring.VerifyCleartext(readTestInRelease(t, "carol"))
+	require.ErrorIs(t, err, ErrUnsupportedAlgorithm)
+	require.True(t, IsUnsupported(err))
+
+	// A signature by a key that isn't in the keyring is still a mismatch
+	_, err = readTestKeyring(t, "bob_cert.asc").VerifyCleartext(readTestInRelease(t, "carol"))
+	require.ErrorIs(t, err, ErrUnknownSigner)
+	require.False(t, IsUnsupported(err))
+	_, err = keyring.VerifyCleartext(readTestInRelease(t, "bob"))
+	require.ErrorIs(t, err, ErrUnknownSigner)
+}
+
+func TestReadSignaturesUnsupportedVersion(t *testing.T) {
+	// A v6 signature packet, which is skipped
+	_, err := ReadSignatures([]byte{0xc2, 0x06, 6, 0x00, 27, 10, 0x00, 0x00})
+	require.ErrorIs(t, err, ErrUnsupportedVersion)
+	require.True(t, IsUnsupported(err))
+}
@@ -0,0 +1,52 @@
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/ericsuh/adapt/aptfile"
+)
+
+const APT_CONF = "/etc/apt/apt.conf.d/90adapt"
+
+const aptConfHeader = "// Managed by adapt from aptconf directives. Changes will be overwritten.\n"
+
+// The managed apt.conf.d file for aptconf directives, in the order given
+func aptConf(dirs []aptfile.AptConfDirective) string {
+	var sb strings.Builder
+	sb.WriteString(aptConfHeader)
+	for _, d := range dirs {
+		fmt.Fprintf(&sb, "%s \"%s\";\n", d.Key, d.Value)
+	}
+	return sb.String()
+}
+
+// Write aptconf directives to APT_CONF before apt is first run, so that
+// every apt command adapt runs uses them. With none, an existing file is
+// emptied rather than left with settings that are no longer wanted.
+func (r *Runner) applyAptConf(dirs []any) error {
+	settings := make([]aptfile.AptConfDirective, 0)
+	for _, d := range dirs {
+		if dir, ok := d.(aptfile.AptConfDirective); ok {
+			settings = append(settings, dir)
+		}
+	}
+	if len(settings) == 0 {
+		if _, err := r.System.ReadFile(APT_CONF); errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	if r.DryRun {
+		for _, d := range settings {
+			fmt.Printf("[dry-run] Would set apt configuration: %s \"%s\"\n", d.Key, d.Value)
+		}
+		fmt.Printf("[dry-run] Would write apt configuration to \"%s\"\n", APT_CONF)
+		return nil
+	}
+	fmt.Printf("Writing apt configuration to %s\n", APT_CONF)
+	return r.System.WriteFile(APT_CONF, []byte(aptConf(settings)), 0644)
+}
@@ -0,0 +1,104 @@
+package runner
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ericsuh/adapt/aptfile"
+)
+
+const APT_AUTH_DIR = "/etc/apt/auth.conf.d"
+
+// Credentials for a repo, as written to auth.conf.d
+type repoAuth struct {
+	// Where the credentials came from, like "env:PPA_CREDENTIALS", which
+	// is safe to show
+	ref string
+	// The host and path they're for, like the "machine" in apt_auth.conf(5)
+	machine  string
+	login    string
+	password string
+}
+
+// Read the credentials an auth reference points to and have downloads
+// from repoURL use them. In dry-run mode nothing is read. Errors say where
+// credentials came from but never what they are.
+func (r *Runner) resolveAuth(ref string, repoURL string) (*repoAuth, error) {
+	machine, err := authMachine(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	auth := &repoAuth{ref: ref, machine: machine}
+	if r.DryRun {
+		return auth, nil
+	}
+	auth.login, auth.password, err = r.readCredentials(ref)
+	if err != nil {
+		return nil, err
+	}
+	r.System.HTTP().SetCredentials(auth.machine, auth.login, auth.password)
+	return auth, nil
+}
+
+// Read "login:password" credentials from an environment variable or a
+// file, relative paths being resolved against the Aptfile's directory
+func (r *Runner) readCredentials(ref string) (string, string, error) {
+	var data string
+	switch {
+	case strings.HasPrefix(ref, aptfile.AUTH_ENV_PREFIX):
+		name := strings.TrimPrefix(ref, aptfile.AUTH_ENV_PREFIX)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", "", fmt.Errorf("environment variable %s for credentials is not set", name)
+		}
+		data = value
+	case strings.HasPrefix(ref, aptfile.AUTH_FILE_PREFIX):
+		path := strings.TrimPrefix(ref, aptfile.AUTH_FILE_PREFIX)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(r.Dir, path)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", "", fmt.Errorf("error reading credentials: %w", err)
+		}
+		data = strings.TrimSpace(string(content))
+	default:
+		// Not shown, in case it's the credentials themselves
+		return "", "", fmt.Errorf("invalid credentials reference, expected %sNAME or %sPATH", aptfile.AUTH_ENV_PREFIX, aptfile.AUTH_FILE_PREFIX)
+	}
+	login, password, found := strings.Cut(data, ":")
+	if !found || login == "" || password == "" || strings.ContainsAny(data, " \t\r\n") {
+		return "", "", fmt.Errorf(`credentials from %s must look like "login:password"`, ref)
+	}
+	return login, password, nil
+}
+
+// The auth.conf "machine" for a repo: its host and path without a scheme
+func authMachine(repoURL string) (string, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid repo URL: %w", err)
+	}
+	return strings.TrimSuffix(u.Host+u.Path, "/"), nil
+}
+
+func authConf(auth *repoAuth) string {
+	return fmt.Sprintf("machine %s\nlogin %s\npassword %s\n", auth.machine, auth.login, auth.password)
+}
+
+// Write a repo's credentials to auth.conf.d, readable only by root, so
+// that they never need to appear in sources.list.d
+func (r *Runner) writeAuth(name string, auth *repoAuth) error {
+	authFile := fmt.Sprintf("%s/%s.conf", APT_AUTH_DIR, name)
+	if r.DryRun {
+		fmt.Printf("[dry-run] Would write credentials from %s for %s to %s\n", auth.ref, auth.machine, authFile)
+		return nil
+	}
+	if err := r.System.WriteFile(authFile, []byte(authConf(auth)), 0600); err != nil {
+		return fmt.Errorf("error writing credentials to %s: %w", authFile, err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package runner
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ericsuh/adapt/aptfile"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyRepoWithAuth(t *testing.T) {
+	// A private repo that serves its key and release file only to bob
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if login, password, ok := r.BasicAuth(); !ok || login != "bob" || password != "s3cret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/repo/key.asc" {
+			http.ServeFile(w, r, filepath.Join("..", "test_data", "alice_cert.asc"))
+			return
+		}
+		http.StripPrefix("/repo", http.FileServer(http.Dir(filepath.Join("..", "test_data", "repos", "alice")))).ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	t.Setenv("ADAPT_TEST_REPO_AUTH", "bob:s3cret")
+
+	repoURL := server.URL + "/repo"
+	dir := aptfile.RepoDirective{URL: repoURL, Suite: "stable", Component: "main", SignedBy: repoURL + "/key.asc", Auth: "env:ADAPT_TEST_REPO_AUTH"}
+	sys := newFakeSystem()
+	sys.client = testDownloader(server)
+	require.NoError(t, New(sys).Apply(context.Background(), []any{dir}))
+
+	name := sanitizeFilename(repoURL)
+	machine := strings.TrimPrefix(repoURL, "http://")
+	require.Equal(t, fakeFile{"machine " + machine + "\nlogin bob\npassword s3cret\n", 0600}, sys.Files[APT_AUTH_DIR+"/"+name+".conf"])
+	require.Equal(t,
+		"deb [signed-by=/usr/share/keyrings/"+name+".gpg] "+repoURL+" stable main",
+		sys.Files["/etc/apt/sources.list.d/"+name+".list"].Data)
+
+	// Dry runs don't read credentials, so they don't need them
+	os.Unsetenv("ADAPT_TEST_REPO_AUTH")
+	sys = newFakeSystem()
+	r := New(sys)
+	r.DryRun = true
+	require.NoError(t, r.Apply(context.Background(), []any{dir}))
+	require.Empty(t, sys.Files)
+}
+
+func TestReadCredentials(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"good":      "bob:s3cret\n",
+		"no-colon":  "bob\n",
+		"spaces":    "bob:s3cret extra\n",
+		"no-login":  ":s3cret",
+		"two-lines": "bob:s3cret\nalice:hunter2\n",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+	}
+	t.Setenv("ADAPT_TEST_CREDENTIALS", "bob:pass:with:colons")
+	tests := []struct {
+		ref      string
+		login    string
+		password string
+		wantErr  string
+	}{
+		{ref: "file:good", login: "bob", password: "s3cret"},
+		{ref: "file:" + filepath.Join(dir, "good"), login: "bob", password: "s3cret"},
+		{ref: "env:ADAPT_TEST_CREDENTIALS", login: "bob", password: "pass:with:colons"},
+		{ref: "env:ADAPT_TEST_UNSET", wantErr: "environment variable ADAPT_TEST_UNSET for credentials is not set"},
+		{ref: "file:missing", wantErr: "error reading credentials"},
+		{ref: "file:no-colon", wantErr: `must look like "login:password"`},
+		{ref: "file:spaces", wantErr: `must look like "login:password"`},
+		{ref: "file:no-login", wantErr: `must look like "login:password"`},
+		{ref: "file:two-lines", wantErr: `must look like "login:password"`},
+		{ref: "bob:s3cret", wantErr: "invalid credentials reference"},
+	}
+	r := New(newFakeSystem())
+	r.Dir = dir
+	for _, tc := range tests {
+		login, password, err := r.readCredentials(tc.ref)
+		if tc.wantErr != "" {
+			require.ErrorContains(t, err, tc.wantErr, tc.ref)
+			require.NotContains(t, err.Error(), "s3cret", tc.ref)
+			continue
+		}
+		require.NoError(t, err, tc.ref)
+		require.Equal(t, tc.login, login, tc.ref)
+		require.Equal(t, tc.password, password, tc.ref)
+	}
+}
+
+func TestAuthMachine(t *testing.T) {
+	for input, expected := range map[string]string{
+		"https://artifactory.example.com/debian/":             "artifactory.example.com/debian",
+		"https://private-ppa.launchpadcontent.net/a/b/ubuntu": "private-ppa.launchpadcontent.net/a/b/ubuntu",
+		"http://apt.example.com:8080":                         "apt.example.com:8080",
+	} {
+		machine, err := authMachine(input)
+		require.NoError(t, err)
+		require.Equal(t, expected, machine, input)
+	}
+}
@@ -0,0 +1,45 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ericsuh/adapt/aptfile"
+)
+
+// Shown in place of secret debconf values
+const REDACTED = "<redacted>"
+
+// A debconf answer as a debconf-set-selections line. Secret values are
+// replaced with REDACTED unless reveal is set.
+func debconfSelection(d aptfile.DebconfDirective, reveal bool) string {
+	value := d.Value
+	if d.IsSecret && !reveal {
+		value = REDACTED
+	}
+	return fmt.Sprintf("%s %s %s %s", d.Package, d.Question, d.Type, value)
+}
+
+// Set debconf answers before anything is installed. They are passed on
+// standard input so that secrets don't show up in the process list or on
+// disk.
+func (r *Runner) preseedDebconf(ctx context.Context, dirs []aptfile.DebconfDirective) error {
+	if len(dirs) == 0 {
+		return nil
+	}
+	var selections strings.Builder
+	for _, d := range dirs {
+		if r.DryRun {
+			fmt.Printf("[dry-run] Would preseed debconf: %s\n", debconfSelection(d, false))
+			continue
+		}
+		fmt.Printf("Preseeding debconf: %s\n", debconfSelection(d, false))
+		selections.WriteString(debconfSelection(d, true))
+		selections.WriteString("\n")
+	}
+	if r.DryRun {
+		return nil
+	}
+	return r.System.Run(ctx, Command{Name: "debconf-set-selections", Stdin: []byte(selections.String())})
+}
@@ -0,0 +1,35 @@
+package runner
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ericsuh/adapt/aptfile"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreseedDebconf(t *testing.T) {
+	dirs := []aptfile.DebconfDirective{
+		{Package: "tzdata", Question: "tzdata/Areas", Type: "select", Value: "Etc"},
+		{Package: "mysql-server", Question: "mysql-server/root_password", Type: "password", Value: "hunter2", IsSecret: true},
+	}
+	sys := newFakeSystem()
+	require.NoError(t, New(sys).preseedDebconf(context.Background(), dirs))
+	require.Equal(t, []Command{{
+		Name:  "debconf-set-selections",
+		Stdin: []byte("tzdata tzdata/Areas select Etc\nmysql-server mysql-server/root_password password hunter2\n"),
+	}}, sys.Commands)
+
+	sys = newFakeSystem()
+	require.NoError(t, New(sys).preseedDebconf(context.Background(), nil))
+	require.Empty(t, sys.Commands)
+}
+
+func TestDebconfSelection(t *testing.T) {
+	secret := aptfile.DebconfDirective{Package: "mysql-server", Question: "mysql-server/root_password", Type: "password", Value: "hunter2", IsSecret: true}
+	require.Equal(t, "mysql-server mysql-server/root_password password "+REDACTED, debconfSelection(secret, false))
+	require.Equal(t, "mysql-server mysql-server/root_password password hunter2", debconfSelection(secret, true))
+
+	plain := aptfile.DebconfDirective{Package: "tzdata", Question: "tzdata/Areas", Type: "select", Value: "Etc"}
+	require.Equal(t, "tzdata tzdata/Areas select Etc", debconfSelection(plain, false))
+}
@@ -0,0 +1,97 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ericsuh/adapt/aptfile"
+)
+
+func (r *Runner) addHold(ctx context.Context, pkg string) error {
+	if r.DryRun {
+		fmt.Printf("[dry-run] Would run `apt-mark hold %s`\n", pkg)
+		return nil
+	}
+	return r.System.Run(ctx, Command{Name: "apt-mark", Args: []string{"hold", pkg}})
+}
+
+func (r *Runner) removeHold(ctx context.Context, pkg string) error {
+	if r.DryRun {
+		fmt.Printf("[dry-run] Would run `apt-mark unhold %s`\n", pkg)
+		return nil
+	}
+	return r.System.Run(ctx, Command{Name: "apt-mark", Args: []string{"unhold", pkg}})
+}
+
+// Unhold the packages of the given holds that are currently held. Packages
+// that aren't held are left alone, since apt-mark fails on packages apt
+// doesn't know of yet, like those from a repo added in this same run.
+func (r *Runner) releaseHolds(ctx context.Context, holds []aptfile.HoldDirective) error {
+	if len(holds) == 0 {
+		return nil
+	}
+	var held []string
+	if !r.DryRun {
+		var err error
+		held, err = r.heldPackages(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	for _, hold := range holds {
+		if !r.DryRun && !slices.Contains(held, hold.PackageName) {
+			continue
+		}
+		if err := r.removeHold(ctx, hold.PackageName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The packages currently held on the system
+func (r *Runner) heldPackages(ctx context.Context) ([]string, error) {
+	out, err := r.System.Output(ctx, Command{Name: "apt-mark", Args: []string{"showhold"}})
+	if err != nil {
+		return nil, fmt.Errorf("error listing held packages: %w", err)
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// Held packages that no hold or unhold directive mentions, which were
+// probably held by hand and will stay held
+func unlistedHolds(held []string, dirs []any) []string {
+	listed := make(map[string]bool)
+	for _, d := range dirs {
+		switch dir := d.(type) {
+		case aptfile.HoldDirective:
+			listed[dir.PackageName] = true
+		case aptfile.UnholdDirective:
+			listed[dir.PackageName] = true
+		}
+	}
+	unlisted := make([]string, 0)
+	for _, pkg := range held {
+		if !listed[pkg] {
+			unlisted = append(unlisted, pkg)
+		}
+	}
+	slices.Sort(unlisted)
+	return unlisted
+}
+
+// Say which packages are held on the system but not in the Aptfile. This
+// only reads the system, so it's done for dry runs, and failing to check
+// isn't fatal.
+func (r *Runner) reportUnlistedHolds(ctx context.Context, dirs []any) {
+	held, err := r.heldPackages(ctx)
+	if err != nil {
+		fmt.Printf("[dry-run] Could not check for held packages: %v\n", err)
+		return
+	}
+	if unlisted := unlistedHolds(held, dirs); len(unlisted) > 0 {
+		fmt.Printf("[dry-run] Held packages not in the Aptfile, which will stay held: %s\n", strings.Join(unlisted, ", "))
+	}
+}
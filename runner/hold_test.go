@@ -0,0 +1,33 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ericsuh/adapt/aptfile"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnlistedHolds(t *testing.T) {
+	dirs := []any{
+		aptfile.PackageDirective{Name: "nginx"},
+		aptfile.HoldDirective{PackageName: "docker-ce"},
+		aptfile.UnholdDirective{PackageName: "containerd.io"},
+	}
+	require.Equal(t, []string{"linux-image-generic", "nginx"}, unlistedHolds([]string{"nginx", "docker-ce", "linux-image-generic", "containerd.io"}, dirs))
+	require.Empty(t, unlistedHolds([]string{"docker-ce"}, dirs))
+	require.Empty(t, unlistedHolds(nil, dirs))
+}
+
+func TestHeldPackages(t *testing.T) {
+	sys := newFakeSystem()
+	sys.Outputs["apt-mark showhold"] = "docker-ce\nlinux-image-generic\n"
+	held, err := New(sys).heldPackages(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{"docker-ce", "linux-image-generic"}, held)
+
+	sys.Errors["apt-mark showhold"] = errors.New("exit status 100")
+	_, err = New(sys).heldPackages(context.Background())
+	require.ErrorContains(t, err, "error listing held packages")
+}
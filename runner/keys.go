@@ -0,0 +1,262 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ericsuh/adapt/aptfile"
+	"github.com/ericsuh/adapt/download"
+	"github.com/ericsuh/adapt/pgp"
+)
+
+const (
+	HKP_DEFAULT_PORT = "11371"
+	WKD_PREFIX       = "wkd:"
+)
+
+// Fetch the signing key for a repo from wherever its options say, and
+// keep only the certificate with the expected fingerprint if one was given.
+func fetchRepoKey(ctx context.Context, client *download.Client, d aptfile.RepoDirective) ([]byte, error) {
+	data, fingerprint, err := fetchRepoKeyData(ctx, client, d)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRepoKey(data, fingerprint)
+}
+
+// Fetch the key data for a repo as-is, armored or not, along with the
+// fingerprint it is expected to have (if known). This is the part of
+// fetchRepoKey that does I/O, so it can be done ahead of time.
+func fetchRepoKeyData(ctx context.Context, client *download.Client, d aptfile.RepoDirective) ([]byte, string, error) {
+	fingerprint := d.Fingerprint
+	var data []byte
+	var err error
+	switch {
+	case d.Keyserver != "":
+		data, err = fetchFromKeyserver(ctx, client, d.Keyserver, fingerprint)
+	case isKeyserverURL(d.SignedBy):
+		var server string
+		server, fingerprint, err = splitKeyserverURL(d.SignedBy, fingerprint)
+		if err != nil {
+			return nil, "", err
+		}
+		data, err = fetchFromKeyserver(ctx, client, server, fingerprint)
+	case strings.HasPrefix(d.SignedBy, WKD_PREFIX):
+		data, err = fetchFromWKD(ctx, client, strings.TrimPrefix(d.SignedBy, WKD_PREFIX))
+	case isInlineKey(d.SignedBy):
+		data = []byte(d.SignedBy)
+	case strings.HasPrefix(d.SignedBy, "http://") || strings.HasPrefix(d.SignedBy, "https://"):
+		data, err = client.GetCached(ctx, d.SignedBy)
+	default:
+		data, err = readLocalKey(d.SignedBy)
+	}
+	return data, fingerprint, err
+}
+
+// Turn fetched key data into a binary keyring. If a fingerprint is given,
+// only the certificate containing that key is kept.
+func decodeRepoKey(data []byte, fingerprint string) ([]byte, error) {
+	keyring, err := decodeKeyring(data)
+	if err != nil {
+		return nil, err
+	}
+	if fingerprint != "" {
+		return selectCertificate(keyring, fingerprint)
+	}
+	return keyring, nil
+}
+
+// A human-readable description of where a repo's key comes from
+func keySource(d aptfile.RepoDirective) string {
+	if d.Keyserver != "" && d.Fingerprint != "" {
+		return fmt.Sprintf("%s (fingerprint %s)", d.Keyserver, d.Fingerprint)
+	} else if d.Keyserver != "" {
+		return d.Keyserver
+	}
+	if isInlineKey(d.SignedBy) {
+		return "inline key"
+	}
+	return d.SignedBy
+}
+
+// Inline keys are given as an armored block, usually with a heredoc
+func isInlineKey(s string) bool {
+	return strings.HasPrefix(strings.TrimSpace(s), "-----BEGIN")
+}
+
+// Read a key from a local path or file:// URL
+func readLocalKey(path string) ([]byte, error) {
+	if strings.HasPrefix(path, "file://") {
+		u, err := url.Parse(path)
+		if err != nil {
+			return nil, err
+		}
+		path = u.Path
+	}
+	return os.ReadFile(path)
+}
+
+// Resolve local signed-by paths relative to the directory containing the
+// Aptfile, so that keys can be checked in next to it.
+func resolveKeyPaths(dirs []any, aptfileDir string) {
+	for i, d := range dirs {
+		repo, ok := d.(aptfile.RepoDirective)
+		if !ok || !isLocalKeyPath(repo.SignedBy) || filepath.IsAbs(repo.SignedBy) {
+			continue
+		}
+		repo.SignedBy = filepath.Join(aptfileDir, repo.SignedBy)
+		dirs[i] = repo
+	}
+}
+
+func isLocalKeyPath(s string) bool {
+	if s == "" || isInlineKey(s) || isKeyserverURL(s) || strings.HasPrefix(s, WKD_PREFIX) {
+		return false
+	}
+	u, err := url.Parse(s)
+	return err != nil || u.Scheme == ""
+}
+
+func isKeyserverURL(s string) bool {
+	return strings.HasPrefix(s, "hkp://") || strings.HasPrefix(s, "hkps://")
+}
+
+// Split a keyserver URL like "hkps://keyserver.ubuntu.com/0xFINGERPRINT"
+// into the server and the fingerprint. The fingerprint may also be given
+// as a "search" query parameter, or separately with the fingerprint option.
+func splitKeyserverURL(s string, fingerprint string) (string, string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", err
+	}
+	fromURL := u.Query().Get("search")
+	if fromURL == "" && u.Path != "/pks/lookup" {
+		fromURL = strings.Trim(u.Path, "/")
+	}
+	fromURL = pgp.NormalizeFingerprint(fromURL)
+	if fromURL != "" && fingerprint != "" && fromURL != fingerprint {
+		return "", "", fmt.Errorf(`fingerprint in "%s" does not match fingerprint %s`, s, fingerprint)
+	}
+	if fromURL == "" {
+		fromURL = fingerprint
+	}
+	if fromURL == "" {
+		return "", "", fmt.Errorf(`keyserver URL "%s" has no fingerprint`, s)
+	}
+	return fmt.Sprintf("%s://%s", u.Scheme, u.Host), fromURL, nil
+}
+
+// Fetch a key by fingerprint using the HKP protocol
+//
+// https://datatracker.ietf.org/doc/html/draft-gallagher-openpgp-hkp
+func fetchFromKeyserver(ctx context.Context, client *download.Client, server string, fingerprint string) ([]byte, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "hkps", "https":
+		u.Scheme = "https"
+	case "hkp", "http":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), HKP_DEFAULT_PORT)
+		}
+		u.Scheme = "http"
+	default:
+		return nil, fmt.Errorf(`unsupported keyserver scheme "%s"`, u.Scheme)
+	}
+	u.Path = "/pks/lookup"
+	u.RawQuery = url.Values{
+		"op":      {"get"},
+		"options": {"mr"},
+		"search":  {"0x" + pgp.NormalizeFingerprint(fingerprint)},
+	}.Encode()
+	return client.Get(ctx, u.String())
+}
+
+// Look up a key by email address in the Web Key Directory, trying the
+// advanced method first and falling back to the direct method.
+//
+// https://datatracker.ietf.org/doc/html/draft-koch-openpgp-webkey-service
+func fetchFromWKD(ctx context.Context, client *download.Client, email string) ([]byte, error) {
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok || local == "" || domain == "" {
+		return nil, fmt.Errorf(`invalid WKD email address "%s"`, email)
+	}
+	domain = strings.ToLower(domain)
+	digest := sha1.Sum([]byte(strings.ToLower(local)))
+	hash := zbase32(digest[:])
+	query := url.Values{"l": {local}}.Encode()
+	urls := []string{
+		fmt.Sprintf("https://openpgpkey.%s/.well-known/openpgpkey/%s/hu/%s?%s", domain, domain, hash, query),
+		fmt.Sprintf("https://%s/.well-known/openpgpkey/hu/%s?%s", domain, hash, query),
+	}
+	var errs []error
+	for _, u := range urls {
+		data, err := client.Get(ctx, u)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("no key found in web key directory for %s: %w", email, errors.Join(errs...))
+}
+
+// Accept a keyring either ASCII-armored or already in binary form, and
+// make sure it actually contains OpenPGP public keys. Keys of a version
+// this package can't read are passed through for apt to handle.
+func decodeKeyring(data []byte) ([]byte, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		return dearmorKeyring(bytes.NewReader(data))
+	}
+	if _, err := pgp.ReadKeyring(data); err != nil && !pgp.IsUnsupported(err) {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Pick out the certificate with the given fingerprint from a keyring,
+// dropping any others a keyserver or web key directory sent along with it
+func selectCertificate(keyring []byte, fingerprint string) ([]byte, error) {
+	keys, err := pgp.ReadKeyring(keyring)
+	if err != nil {
+		return nil, err
+	}
+	if keys.ByFingerprint(fingerprint) != nil {
+		return pgp.Certificate(keyring, fingerprint)
+	}
+	found := make([]string, len(keys))
+	for i, k := range keys {
+		found[i] = k.FingerprintString()
+	}
+	return nil, fmt.Errorf("key fingerprint mismatch: expected %s, got %s", pgp.NormalizeFingerprint(fingerprint), strings.Join(found, ", "))
+}
+
+const zbase32Alphabet = "ybndrfg8ejkmcpqxot1uwisza345h769"
+
+// Encode data with the human-oriented base-32 encoding used by WKD
+func zbase32(data []byte) string {
+	var sb strings.Builder
+	var buffer, bits uint
+	for _, b := range data {
+		buffer = buffer<<8 | uint(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			sb.WriteByte(zbase32Alphabet[(buffer>>bits)&0x1f])
+		}
+	}
+	if bits > 0 {
+		sb.WriteByte(zbase32Alphabet[(buffer<<(5-bits))&0x1f])
+	}
+	return sb.String()
+}
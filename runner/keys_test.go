@@ -0,0 +1,299 @@
+package runner
+
+import (
+	"context"
+	"crypto/sha1"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ericsuh/adapt/aptfile"
+	"github.com/ericsuh/adapt/download"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	aliceFingerprint = "EB85BB5FA33A75E15E944E63F231550C4F47E38E"
+	bobFingerprint   = "D1A66E1A23B182C9980F788CFBFCC82A015E7330"
+)
+
+// A stand-in keyserver that serves test_data certificates by fingerprint
+func newTestKeyserver(t *testing.T) *httptest.Server {
+	t.Helper()
+	certs := map[string]string{
+		"0x" + aliceFingerprint: "alice_cert.asc",
+		"0x" + bobFingerprint:   "bob_cert.asc",
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pks/lookup", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("op") != "get" {
+			http.Error(w, "bad op", http.StatusBadRequest)
+			return
+		}
+		f, ok := certs[r.URL.Query().Get("search")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join("..", "test_data", f))
+	})
+	return httptest.NewServer(mux)
+}
+
+// A client that sends every request to server, whatever the host, so that
+// lookups for real-looking domains can be served locally
+func redirectingClient(server *httptest.Server) *download.Client {
+	client := server.Client()
+	transport := client.Transport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+	}
+	client.Transport = transport
+	return &download.Client{HTTP: client}
+}
+
+func TestFetchRepoKeyFromKeyserver(t *testing.T) {
+	server := newTestKeyserver(t)
+	defer server.Close()
+	hkpURL := strings.Replace(server.URL, "http://", "hkp://", 1)
+
+	tests := []struct {
+		name    string
+		dir     aptfile.RepoDirective
+		wantErr string
+	}{
+		{
+			name: "keyserver and fingerprint options",
+			dir:  aptfile.RepoDirective{Keyserver: hkpURL, Fingerprint: bobFingerprint},
+		},
+		{
+			name: "fingerprint in signed-by path",
+			dir:  aptfile.RepoDirective{SignedBy: hkpURL + "/0x" + aliceFingerprint},
+		},
+		{
+			name: "fingerprint in signed-by query",
+			dir:  aptfile.RepoDirective{SignedBy: hkpURL + "/pks/lookup?op=get&search=0x" + aliceFingerprint},
+		},
+		{
+			name:    "unknown key",
+			dir:     aptfile.RepoDirective{Keyserver: hkpURL, Fingerprint: strings.Repeat("A", 40)},
+			wantErr: "404 Not Found",
+		},
+		{
+			name:    "conflicting fingerprints",
+			dir:     aptfile.RepoDirective{SignedBy: hkpURL + "/0x" + aliceFingerprint, Fingerprint: bobFingerprint},
+			wantErr: "does not match",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			keyring, err := fetchRepoKey(context.Background(), testDownloader(server), tc.dir)
+			if tc.wantErr != "" {
+				require.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.NotEmpty(t, keyring)
+		})
+	}
+}
+
+func TestFetchRepoKeyChecksFingerprint(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir(filepath.Join("..", "test_data"))))
+	defer server.Close()
+
+	d := aptfile.RepoDirective{SignedBy: server.URL + "/bob_cert.asc", Fingerprint: bobFingerprint}
+	_, err := fetchRepoKey(context.Background(), testDownloader(server), d)
+	require.NoError(t, err)
+
+	d.Fingerprint = aliceFingerprint
+	_, err = fetchRepoKey(context.Background(), testDownloader(server), d)
+	require.ErrorContains(t, err, "fingerprint mismatch")
+	require.ErrorContains(t, err, bobFingerprint)
+}
+
+func TestFetchRepoKeyDropsOtherCertificates(t *testing.T) {
+	var response []byte
+	certs := make(map[string][]byte)
+	for _, f := range []string{"alice_cert.asc", "bob_cert.asc"} {
+		content, err := os.ReadFile(filepath.Join("..", "test_data", f))
+		require.NoError(t, err)
+		response = append(response, content...)
+		certs[f], err = decodeKeyring(content)
+		require.NoError(t, err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(response)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name        string
+		fingerprint string
+		expected    string
+	}{
+		{name: "first certificate", fingerprint: aliceFingerprint, expected: "alice_cert.asc"},
+		{name: "last certificate", fingerprint: bobFingerprint, expected: "bob_cert.asc"},
+		{name: "subkey fingerprint", fingerprint: "EA02B24FFD4C1B96616D3DF24766F6B9D5F21EB6", expected: "alice_cert.asc"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := aptfile.RepoDirective{SignedBy: server.URL + "/keys.asc", Fingerprint: tc.fingerprint}
+			keyring, err := fetchRepoKey(context.Background(), testDownloader(server), d)
+			require.NoError(t, err)
+			require.Equal(t, certs[tc.expected], keyring)
+		})
+	}
+
+	// Without a fingerprint there is nothing to choose by, so both are kept
+	d := aptfile.RepoDirective{SignedBy: server.URL + "/keys.asc"}
+	keyring, err := fetchRepoKey(context.Background(), testDownloader(server), d)
+	require.NoError(t, err)
+	require.Equal(t, append(append([]byte{}, certs["alice_cert.asc"]...), certs["bob_cert.asc"]...), keyring)
+}
+
+func TestFetchRepoKeyFromWKD(t *testing.T) {
+	cert, err := os.ReadFile(filepath.Join("..", "test_data", "alice_cert.asc"))
+	require.NoError(t, err)
+	binary, err := decodeKeyring(cert)
+	require.NoError(t, err)
+
+	for _, advanced := range []bool{true, false} {
+		name := "direct"
+		if advanced {
+			name = "advanced"
+		}
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hash := zbase32Hash("alice")
+				var expectedPath string
+				if strings.HasPrefix(r.Host, "openpgpkey.") {
+					if !advanced {
+						http.NotFound(w, r)
+						return
+					}
+					expectedPath = "/.well-known/openpgpkey/example.com/hu/" + hash
+				} else {
+					expectedPath = "/.well-known/openpgpkey/hu/" + hash
+				}
+				if r.URL.Path != expectedPath || r.URL.Query().Get("l") != "alice" {
+					http.NotFound(w, r)
+					return
+				}
+				_, _ = w.Write(binary)
+			}))
+			defer server.Close()
+
+			d := aptfile.RepoDirective{SignedBy: "wkd:alice@Example.com", Fingerprint: aliceFingerprint}
+			keyring, err := fetchRepoKey(context.Background(), redirectingClient(server), d)
+			require.NoError(t, err)
+			require.Equal(t, binary, keyring)
+		})
+	}
+}
+
+func zbase32Hash(local string) string {
+	digest := sha1.Sum([]byte(local))
+	return zbase32(digest[:])
+}
+
+func TestZBase32(t *testing.T) {
+	// Example from the Web Key Directory draft
+	require.Equal(t, "iy9q119eutrkn8s1mk4r39qejnbu3n5q", zbase32Hash("joe.doe"))
+}
+
+func TestSplitKeyserverURL(t *testing.T) {
+	server, fpr, err := splitKeyserverURL("hkps://keyserver.ubuntu.com/0x"+strings.ToLower(bobFingerprint), "")
+	require.NoError(t, err)
+	require.Equal(t, "hkps://keyserver.ubuntu.com", server)
+	require.Equal(t, bobFingerprint, fpr)
+
+	server, fpr, err = splitKeyserverURL("hkps://keyserver.ubuntu.com", bobFingerprint)
+	require.NoError(t, err)
+	require.Equal(t, "hkps://keyserver.ubuntu.com", server)
+	require.Equal(t, bobFingerprint, fpr)
+
+	_, _, err = splitKeyserverURL("hkps://keyserver.ubuntu.com", "")
+	require.Error(t, err)
+}
+
+func TestFetchRepoKeyLocal(t *testing.T) {
+	inline, err := os.ReadFile(filepath.Join("..", "test_data", "bob_cert.asc"))
+	require.NoError(t, err)
+	binary, err := os.ReadFile(filepath.Join("..", "test_data", "key.gpg"))
+	require.NoError(t, err)
+	abs, err := filepath.Abs(filepath.Join("..", "test_data", "alice_cert.asc"))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		signedBy    string
+		fingerprint string
+		expected    []byte
+	}{
+		{
+			name:        "path relative to Aptfile",
+			signedBy:    "alice_cert.asc",
+			fingerprint: aliceFingerprint,
+		},
+		{
+			name:        "file URL",
+			signedBy:    "file://" + abs,
+			fingerprint: aliceFingerprint,
+		},
+		{
+			name:     "binary keyring",
+			signedBy: "key.gpg",
+			expected: binary,
+		},
+		{
+			name:        "inline key",
+			signedBy:    string(inline),
+			fingerprint: bobFingerprint,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dirs := []any{aptfile.RepoDirective{SignedBy: tc.signedBy, Fingerprint: tc.fingerprint}}
+			resolveKeyPaths(dirs, filepath.Join("..", "test_data"))
+			keyring, err := fetchRepoKey(context.Background(), &download.Client{HTTP: http.DefaultClient}, dirs[0].(aptfile.RepoDirective))
+			require.NoError(t, err)
+			if tc.expected != nil {
+				require.Equal(t, tc.expected, keyring)
+			}
+		})
+	}
+}
+
+func TestResolveKeyPaths(t *testing.T) {
+	dirs := []any{
+		aptfile.RepoDirective{SignedBy: "keys/vendor.asc"},
+		aptfile.RepoDirective{SignedBy: "/etc/keys/vendor.asc"},
+		aptfile.RepoDirective{SignedBy: "https://example.com/key.asc"},
+		aptfile.RepoDirective{SignedBy: "file:///etc/keys/vendor.asc"},
+		aptfile.RepoDirective{SignedBy: "wkd:user@example.com"},
+		aptfile.RepoDirective{SignedBy: "-----BEGIN PGP PUBLIC KEY BLOCK-----\n"},
+		aptfile.PackageDirective{Name: "curl"},
+	}
+	resolveKeyPaths(dirs, "/srv/build")
+	require.Equal(t, []any{
+		aptfile.RepoDirective{SignedBy: "/srv/build/keys/vendor.asc"},
+		aptfile.RepoDirective{SignedBy: "/etc/keys/vendor.asc"},
+		aptfile.RepoDirective{SignedBy: "https://example.com/key.asc"},
+		aptfile.RepoDirective{SignedBy: "file:///etc/keys/vendor.asc"},
+		aptfile.RepoDirective{SignedBy: "wkd:user@example.com"},
+		aptfile.RepoDirective{SignedBy: "-----BEGIN PGP PUBLIC KEY BLOCK-----\n"},
+		aptfile.PackageDirective{Name: "curl"},
+	}, dirs)
+}
+
+func TestFetchRepoKeyRejectsNonKeyFile(t *testing.T) {
+	_, err := fetchRepoKey(context.Background(), &download.Client{HTTP: http.DefaultClient}, aptfile.RepoDirective{SignedBy: filepath.Join("..", "test_data", "Aptfile")})
+	require.Error(t, err)
+}
@@ -0,0 +1,579 @@
+// Package runner applies parsed Aptfile directives to a system. It is what
+// the adapt command uses, and can be used directly by programs that want
+// to provision machines from Go.
+package runner
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/ericsuh/adapt/aptfile"
+	"github.com/ericsuh/adapt/armor"
+	"github.com/ericsuh/adapt/deb"
+)
+
+// Applies directives, keeping track of what it has done so far so that
+// package lists are only updated when needed. A Runner can apply several
+// Aptfiles in turn, but only one at a time.
+type Runner struct {
+	System System
+	// Print what would be done instead of doing it
+	DryRun bool
+	// Settings for downloads. Config directives fill in anything left empty.
+	Network NetworkConfig
+	// How many downloads to run at once
+	Jobs int
+	// Directory that relative paths in directives are resolved against,
+	// normally the Aptfile's
+	Dir string
+	// Where PPAs are looked up, downloaded from and their keys fetched.
+	// New sets these to Launchpad's.
+	LaunchpadAPI      string
+	PPABaseURL        string
+	PrivatePPABaseURL string
+	PPAKeyserver      string
+
+	listsUpdated bool
+}
+
+func New(sys System) *Runner {
+	return &Runner{
+		System:            sys,
+		Jobs:              DEFAULT_JOBS,
+		Dir:               ".",
+		LaunchpadAPI:      LAUNCHPAD_API,
+		PPABaseURL:        PPA_BASE_URL,
+		PrivatePPABaseURL: PRIVATE_PPA_BASE_URL,
+		PPAKeyserver:      PPA_KEYSERVER,
+	}
+}
+
+// A repo or PPA as it will be written to sources.list.d
+type resolvedRepo struct {
+	repo aptfile.RepoDirective
+	// Base name for the source, keyring and auth files
+	name string
+	// Add a deb-src line as well as the deb one
+	alsoSrc bool
+	// Credentials to write to auth.conf.d, if the repo needs them
+	auth *repoAuth
+}
+
+// Returned by Apply when its context is cancelled part way through
+type CancelledError struct {
+	// The directives that were fully applied, in the order they were
+	Completed []any
+	Total     int
+	// The context's error and its cause, which is a *SignalError if adapt
+	// was stopped by a signal
+	Err   error
+	Cause error
+}
+
+func (e *CancelledError) Error() string {
+	return fmt.Sprintf("cancelled (%v) after completing %d of %d directives", e.Cause, len(e.Completed), e.Total)
+}
+
+func (e *CancelledError) Unwrap() []error {
+	return []error{e.Err, e.Cause}
+}
+
+// Apply directives as returned by aptfile.Parse, stopping at the first one
+// that fails. Debconf answers are set first, then repos, PPAs, .deb files,
+// pins and holds are applied in order, then all packages are installed
+// together, along with packages held at a version, which are held once
+// installed. If ctx is cancelled, running commands are signalled and waited
+// for, and a *CancelledError says which directives were completed.
+func (r *Runner) Apply(ctx context.Context, dirs []any) error {
+	completed := make([]any, 0, len(dirs))
+	err := r.apply(ctx, dirs, &completed)
+	if err != nil && ctx.Err() != nil {
+		return &CancelledError{Completed: completed, Total: len(dirs), Err: ctx.Err(), Cause: context.Cause(ctx)}
+	}
+	return err
+}
+
+func (r *Runner) apply(ctx context.Context, dirs []any, completed *[]any) error {
+	dirs = slices.Clone(dirs)
+	resolveKeyPaths(dirs, r.Dir)
+
+	// Network settings apply to every download, wherever they appear in the file
+	network := mergeNetworkConfig(dirs, r.Network, r.Dir)
+	if err := r.applyNetworkConfig(network); err != nil {
+		return fmt.Errorf("failed to apply network configuration: %w", err)
+	}
+	// As do apt settings to every apt command
+	if err := r.applyAptConf(dirs); err != nil {
+		return fmt.Errorf("failed to write apt configuration: %w", err)
+	}
+	for _, d := range dirs {
+		switch d.(type) {
+		case aptfile.ConfigDirective, aptfile.AptConfDirective:
+			*completed = append(*completed, d)
+		}
+	}
+
+	// Work out what each repo and PPA will write, and which credentials
+	// downloads need. A PPA is a repo once Launchpad has said what it's
+	// signed with.
+	repos := make(map[int]resolvedRepo)
+	toFetch := slices.Clone(dirs)
+	for i, d := range dirs {
+		switch dir := d.(type) {
+		case aptfile.RepoDirective:
+			repo := resolvedRepo{repo: dir, name: sanitizeFilename(dir.URL)}
+			if dir.Auth != "" {
+				auth, err := r.resolveAuth(dir.Auth, dir.URL)
+				if err != nil {
+					return fmt.Errorf("failed to add repo %s: %w", dir.URL, err)
+				}
+				repo.auth = auth
+			}
+			repos[i] = repo
+		case aptfile.PpaDirective:
+			ppa, err := r.resolvePPA(ctx, dir)
+			if err != nil {
+				return fmt.Errorf("failed to add PPA %s: %w", dir.Name, err)
+			}
+			repos[i] = ppa
+			toFetch[i] = ppa.repo
+		}
+	}
+
+	// Download keys and .deb files up front, several at a time
+	fetched := &prefetched{}
+	if !r.DryRun {
+		var err error
+		fetched, err = prefetch(ctx, r.System.HTTP(), toFetch, r.Jobs)
+		if err != nil {
+			return fmt.Errorf("failed to download: %w", err)
+		}
+	}
+	defer fetched.release()
+
+	// Answer debconf questions before any package, .deb or not, asks them
+	debconf := make([]aptfile.DebconfDirective, 0)
+	for _, d := range dirs {
+		if dir, ok := d.(aptfile.DebconfDirective); ok {
+			debconf = append(debconf, dir)
+		}
+	}
+	if err := r.preseedDebconf(ctx, debconf); err != nil {
+		return fmt.Errorf("failed to preseed debconf: %w", err)
+	}
+	for _, d := range debconf {
+		*completed = append(*completed, d)
+	}
+
+	if r.DryRun {
+		r.reportUnlistedHolds(ctx, dirs)
+	}
+
+	pkgs := make([]aptfile.PackageDirective, 0)
+	versionHolds := make([]aptfile.HoldDirective, 0)
+
+	// First pass, skip package installation (except for .deb files,
+	// which can be necessary for setting up repos or keyrings, etc.)
+	for i, d := range dirs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		switch dir := d.(type) {
+		case aptfile.PpaDirective:
+			fmt.Printf("Adding PPA: %s\n", dir.Name)
+			if err := r.addRepo(ctx, repos[i], fetched.keys[i]); err != nil {
+				return fmt.Errorf("failed to add PPA %s: %w", dir.Name, err)
+			} else {
+				r.listsUpdated = false
+			}
+		case aptfile.RepoDirective:
+			if err := r.addRepo(ctx, repos[i], fetched.keys[i]); err != nil {
+				return fmt.Errorf("failed to add repository: %w", err)
+			} else {
+				r.listsUpdated = false
+			}
+		case aptfile.PackageDirective:
+			pkgs = append(pkgs, dir)
+			// Don't install in this phase
+			continue
+		case aptfile.DebFileDirective:
+			if err := r.installDeb(ctx, dir, fetched.debs[i]); err != nil {
+				return fmt.Errorf("failed to install deb %s: %w", dir.Path, err)
+			}
+		case aptfile.PinDirective:
+			if err := r.addPinPreference(ctx, dir); err != nil {
+				return fmt.Errorf("failed to add pin: %w", err)
+			}
+		case aptfile.HoldDirective:
+			if dir.Version != "" {
+				// Installed with the other packages, then held
+				pkgs = append(pkgs, aptfile.PackageDirective{Name: dir.PackageName, Version: dir.Version})
+				versionHolds = append(versionHolds, dir)
+				continue
+			}
+			if err := r.addHold(ctx, dir.PackageName); err != nil {
+				return fmt.Errorf("failed to add hold: %w", err)
+			}
+		case aptfile.UnholdDirective:
+			if err := r.removeHold(ctx, dir.PackageName); err != nil {
+				return fmt.Errorf("failed to remove hold: %w", err)
+			}
+		case aptfile.ConfigDirective, aptfile.AptConfDirective, aptfile.DebconfDirective:
+			// Already applied
+			continue
+		default:
+			return fmt.Errorf("unknown directive: %v", d)
+		}
+		*completed = append(*completed, d)
+	}
+
+	if err := r.removeStalePins(dirs); err != nil {
+		return fmt.Errorf("failed to remove old pins: %w", err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// A package held at another version can't be changed, so it's let go
+	// of until the wanted version is installed
+	if err := r.releaseHolds(ctx, versionHolds); err != nil {
+		return fmt.Errorf("failed to remove hold: %w", err)
+	}
+	if err := r.installPackages(ctx, pkgs); err != nil {
+		return fmt.Errorf("failed to install packages: %w", err)
+	}
+	for _, d := range dirs {
+		if _, ok := d.(aptfile.PackageDirective); ok {
+			*completed = append(*completed, d)
+		}
+	}
+	for _, hold := range versionHolds {
+		if err := r.addHold(ctx, hold.PackageName); err != nil {
+			return fmt.Errorf("failed to add hold: %w", err)
+		}
+		*completed = append(*completed, hold)
+	}
+	return nil
+}
+
+// A short description of a directive, like "package curl"
+func Describe(d any) string {
+	switch dir := d.(type) {
+	case aptfile.PackageDirective:
+		return "package " + packageSpec(dir)
+	case aptfile.PpaDirective:
+		return "ppa " + dir.Name
+	case aptfile.RepoDirective:
+		kind := "repo"
+		if dir.IsSrc {
+			kind = "repo-src"
+		}
+		return strings.TrimSpace(fmt.Sprintf("%s %s %s %s", kind, dir.URL, dir.Suite, dir.Component))
+	case aptfile.DebFileDirective:
+		return "deb " + dir.Path
+	case aptfile.PinDirective:
+		return "pin " + dir.PackageName
+	case aptfile.HoldDirective:
+		if dir.Version != "" {
+			return fmt.Sprintf("hold %s=%s", dir.PackageName, dir.Version)
+		}
+		return "hold " + dir.PackageName
+	case aptfile.UnholdDirective:
+		return "unhold " + dir.PackageName
+	case aptfile.ConfigDirective:
+		return "config " + dir.Key
+	case aptfile.DebconfDirective:
+		return "debconf " + dir.Question
+	case aptfile.AptConfDirective:
+		return "aptconf " + dir.Key
+	default:
+		return fmt.Sprintf("%v", d)
+	}
+}
+
+// The argument to apt-get install for a package
+func packageSpec(p aptfile.PackageDirective) string {
+	if p.Version != "" {
+		return fmt.Sprintf("%s=%s", p.Name, p.Version)
+	} else if p.Release != "" {
+		return fmt.Sprintf("%s/%s", p.Name, p.Release)
+	}
+	return p.Name
+}
+
+func (r *Runner) installPackages(ctx context.Context, pkgs []aptfile.PackageDirective) error {
+	names := make([]string, len(pkgs))
+	for i, p := range pkgs {
+		names[i] = packageSpec(p)
+	}
+	if r.DryRun {
+		if !r.listsUpdated {
+			fmt.Println("[dry-run] Would update package lists")
+		}
+		fmt.Printf("[dry-run] Would install packagess: %s\n", strings.Join(names, ", "))
+		return nil
+	}
+	if !r.listsUpdated {
+		fmt.Printf("Updating package lists...\n")
+		cmd := Command{Name: "apt-get", Args: []string{"update", "--yes"}, Env: []string{"DEBIAN_FRONTEND=noninteractive"}}
+		if err := r.System.Run(ctx, cmd); err != nil {
+			return fmt.Errorf("error updating package lists: %w", err)
+		}
+		r.listsUpdated = true
+	}
+	fmt.Printf("Installing package: %s\n", strings.Join(names, ", "))
+	return r.System.Run(ctx, Command{
+		Name: "apt-get",
+		Args: slices.Concat([]string{"install", "--yes", "--no-install-recommends"}, names),
+		Env:  []string{"DEBIAN_FRONTEND=noninteractive"},
+	})
+}
+
+// Install a .deb file. Remote files have already been downloaded by
+// prefetch, to the path in downloaded.
+func (r *Runner) installDeb(ctx context.Context, d aptfile.DebFileDirective, downloaded string) error {
+	debFile := d.Path
+	path := d.Path
+
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		if r.DryRun {
+			fmt.Printf("[dry-run] Would download .deb from: %s\n", path)
+		} else if downloaded == "" {
+			return fmt.Errorf("%s was not downloaded", path)
+		} else {
+			debFile = downloaded
+		}
+	}
+
+	if r.DryRun {
+		if d.SHA256 != "" || d.SHA512 != "" {
+			fmt.Printf("[dry-run] Would verify checksum of .deb: %s\n", debFile)
+		}
+		fmt.Printf("[dry-run] Would install .deb: %s\n", debFile)
+		return nil
+	}
+
+	if err := verifyChecksums(debFile, d.SHA256, d.SHA512); err != nil {
+		return err
+	}
+	control, err := r.inspectDeb(ctx, debFile)
+	if err != nil {
+		return fmt.Errorf("%s is not a valid .deb: %w", path, err)
+	}
+	archs, err := r.systemArchitectures(ctx)
+	if err != nil {
+		return err
+	}
+	if err := checkDebArchitecture(control, archs); err != nil {
+		return fmt.Errorf("cannot install %s: %w", path, err)
+	}
+
+	fmt.Printf("Installing .deb: %s\n", control)
+	staged, done, err := r.System.Stage(debFile)
+	if err != nil {
+		return err
+	}
+	defer done()
+	cmd := Command{Name: "dpkg", Args: []string{"-i", staged}, Env: []string{"DEBIAN_FRONTEND=noninteractive"}}
+	// Try with apt-get instead
+	if err := r.System.Run(ctx, cmd); err != nil {
+		err := r.System.Run(ctx, Command{Name: "apt-get", Args: []string{"install", "-f", "-y"}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add a repo to sources.list.d, installing its key if it has one. The key
+// has already been downloaded by prefetch.
+func (r *Runner) addRepo(ctx context.Context, rr resolvedRepo, key fetchedKey) error {
+	d := rr.repo
+	name := rr.name
+	repoTypes := []string{"deb"}
+	if d.IsSrc {
+		repoTypes = []string{"deb-src"}
+	} else if rr.alsoSrc {
+		repoTypes = append(repoTypes, "deb-src")
+	}
+
+	if rr.auth != nil {
+		if err := r.writeAuth(name, rr.auth); err != nil {
+			return err
+		}
+	}
+
+	keyringPath := ""
+	if d.SignedBy != "" || d.Keyserver != "" {
+		keyringPath = fmt.Sprintf("/usr/share/keyrings/%s.gpg", name)
+		if r.DryRun {
+			fmt.Printf("[dry-run] Would download GPG key from: %s\n", keySource(d))
+			fmt.Printf("[dry-run] Would verify repository signature: %s\n", releaseBaseURL(d))
+		} else {
+			if key.data == nil {
+				return fmt.Errorf("key for %s was not downloaded", d.URL)
+			}
+			keyring, err := decodeRepoKey(key.data, key.fingerprint)
+			if err != nil {
+				return err
+			}
+			if err := verifyRepoSignature(ctx, r.System.HTTP(), d, keyring); err != nil {
+				return err
+			}
+			if err := r.System.WriteFile(keyringPath, keyring, 0644); err != nil {
+				return err
+			}
+		}
+	}
+
+	listFile := fmt.Sprintf("/etc/apt/sources.list.d/%s.list", name)
+	opts := make([]string, 0)
+	if d.Arch != "" {
+		opts = append(opts, fmt.Sprintf("arch=%s", d.Arch))
+	}
+	if keyringPath != "" {
+		opts = append(opts, fmt.Sprintf("signed-by=%s", keyringPath))
+	}
+	sourceLines := make([]string, len(repoTypes))
+	for i, repoType := range repoTypes {
+		if len(opts) > 0 {
+			sourceLines[i] = fmt.Sprintf("%s [%s] %s %s %s", repoType, strings.Join(opts, " "), d.URL, d.Suite, d.Component)
+		} else {
+			sourceLines[i] = fmt.Sprintf("%s %s %s %s", repoType, d.URL, d.Suite, d.Component)
+		}
+	}
+	if r.DryRun {
+		for _, line := range sourceLines {
+			fmt.Printf("[dry-run] Would add repository: %s\n", line)
+		}
+		return nil
+	}
+	return r.System.WriteFile(listFile, []byte(strings.Join(sourceLines, "\n")), 0644)
+}
+
+// Concatenate every public key block in the input into a single binary
+// keyring. Vendors sometimes ship the current and next signing keys together
+// in one file, and apt needs all of them. Any other kind of block (e.g. a
+// detached signature given by mistake) is rejected.
+func dearmorKeyring(r io.Reader) ([]byte, error) {
+	keyring := make([]byte, 0)
+	dec := armor.NewDecoder(r)
+	for {
+		block, err := dec.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if block.Type != armor.BLOCK_TYPE_PUBLIC_KEY {
+			return nil, fmt.Errorf(`expected "%s" but found "%s"`, armor.BLOCK_TYPE_PUBLIC_KEY, block.Type)
+		}
+		if comment := block.Header("Comment"); comment != "" {
+			fmt.Printf("Installing key: %s\n", comment)
+		}
+		keyring = append(keyring, block.Body...)
+	}
+	if len(keyring) == 0 {
+		return nil, errors.New("no public key blocks found")
+	}
+	return keyring, nil
+}
+
+// Read the control fields of a .deb, making sure it really is one. Control
+// archives compressed with xz or zstd can't be read with the standard
+// library, so for those dpkg-deb is asked instead.
+func (r *Runner) inspectDeb(ctx context.Context, path string) (*deb.Control, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err2 := f.Close(); err2 != nil {
+			log.Printf("Error closing file: %v", err2)
+		}
+	}()
+	control, err := deb.ReadControl(f)
+	if errors.Is(err, deb.ErrUnsupportedCompression) {
+		staged, done, err := r.System.Stage(path)
+		if err != nil {
+			return nil, err
+		}
+		defer done()
+		out, err := r.System.Output(ctx, Command{Name: "dpkg-deb", Args: []string{"--field", staged}})
+		if err != nil {
+			return nil, fmt.Errorf("error reading control file with dpkg-deb: %w", err)
+		}
+		return deb.ParseControl(bytes.NewReader(out))
+	}
+	return control, err
+}
+
+// The native and any foreign architectures dpkg is configured for
+func (r *Runner) systemArchitectures(ctx context.Context) ([]string, error) {
+	native, err := r.System.Output(ctx, Command{Name: "dpkg", Args: []string{"--print-architecture"}})
+	if err != nil {
+		return nil, fmt.Errorf("error getting dpkg architecture: %w", err)
+	}
+	foreign, err := r.System.Output(ctx, Command{Name: "dpkg", Args: []string{"--print-foreign-architectures"}})
+	if err != nil {
+		return nil, fmt.Errorf("error getting dpkg foreign architectures: %w", err)
+	}
+	return append(strings.Fields(string(native)), strings.Fields(string(foreign))...), nil
+}
+
+func checkDebArchitecture(control *deb.Control, archs []string) error {
+	if control.Architecture == "all" || slices.Contains(archs, control.Architecture) {
+		return nil
+	}
+	return fmt.Errorf("package %s is for architecture %s, but this system supports %s", control.Package, control.Architecture, strings.Join(archs, ", "))
+}
+
+// Check a file against expected hex-encoded digests. Empty digests are skipped.
+func verifyChecksums(path string, sha256Digest string, sha512Digest string) error {
+	if sha256Digest == "" && sha512Digest == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := f.Close(); err2 != nil {
+			log.Printf("Error closing file: %v", err2)
+		}
+	}()
+	h256 := sha256.New()
+	h512 := sha512.New()
+	if _, err := io.Copy(io.MultiWriter(h256, h512), f); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h256.Sum(nil)); sha256Digest != "" && actual != sha256Digest {
+		return fmt.Errorf("checksum mismatch for %s: expected sha256:%s, got sha256:%s", path, sha256Digest, actual)
+	}
+	if actual := hex.EncodeToString(h512.Sum(nil)); sha512Digest != "" && actual != sha512Digest {
+		return fmt.Errorf("checksum mismatch for %s: expected sha512:%s, got sha512:%s", path, sha512Digest, actual)
+	}
+	return nil
+}
+
+var okFileCharsRegex = regexp.MustCompile(`[^a-zA-Z0-9-_]+`)
+
+func sanitizeFilename(s string) string {
+	s = okFileCharsRegex.ReplaceAllString(s, "_")
+	s = strings.Trim(s, "_")
+	if len(s) > 50 {
+		s = s[:50]
+	}
+	return strings.ToLower(s)
+}
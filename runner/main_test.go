@@ -0,0 +1,510 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"maps"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/ericsuh/adapt/aptfile"
+	"github.com/ericsuh/adapt/armor"
+	"github.com/ericsuh/adapt/deb"
+	"github.com/ericsuh/adapt/download"
+	"github.com/stretchr/testify/require"
+)
+
+func testDownloader(server *httptest.Server) *download.Client {
+	return &download.Client{HTTP: server.Client()}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "normal URL",
+			input:    "https://example.com/repo",
+			expected: "https_example_com_repo",
+		},
+		{
+			name:     "URL with special characters",
+			input:    "https://deb.nodesource.com/node_20.x",
+			expected: "https_deb_nodesource_com_node_20_x",
+		},
+		{
+			name:     "very long URL",
+			input:    "https://very-long-domain-name.example.com/with/many/path/segments/that/exceed/limit",
+			expected: "https_very-long-domain-name_example_com_with_many_",
+		},
+		{
+			name:     "URL with port",
+			input:    "http://example.com:8080/repo",
+			expected: "http_example_com_8080_repo",
+		},
+		{
+			name:     "empty string",
+			input:    "",
+			expected: "",
+		},
+		{
+			name:     "only special characters",
+			input:    "!!!@@@###$$$",
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sanitizeFilename(tt.input)
+			if got != tt.expected {
+				t.Errorf("sanitizeFilename() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDearmorKeyringConcatenatesKeys(t *testing.T) {
+	var input []byte
+	var expected []byte
+	for _, f := range []string{"alice_cert.asc", "key.gpg.asc"} {
+		content, err := os.ReadFile(filepath.Join("..", "test_data", f))
+		require.NoError(t, err)
+		input = append(input, content...)
+		block, err := armor.Parse(bytes.NewReader(content))
+		require.NoError(t, err)
+		expected = append(expected, block.Body...)
+	}
+
+	keyring, err := dearmorKeyring(bytes.NewReader(input))
+	require.NoError(t, err)
+	require.Equal(t, expected, keyring)
+}
+
+func TestDearmorKeyringTrailingText(t *testing.T) {
+	content, err := os.ReadFile(filepath.Join("..", "test_data", "key.gpg.asc"))
+	require.NoError(t, err)
+	block, err := armor.Parse(bytes.NewReader(content))
+	require.NoError(t, err)
+
+	input := append(append([]byte{}, content...), "Import this key with apt-key add.\n"...)
+	keyring, err := dearmorKeyring(bytes.NewReader(input))
+	require.NoError(t, err)
+	require.Equal(t, block.Body, keyring)
+}
+
+func TestDearmorKeyringRequiresKey(t *testing.T) {
+	_, err := dearmorKeyring(strings.NewReader(""))
+	require.Error(t, err)
+}
+
+func TestDearmorKeyringRejectsSignature(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, armor.Encode(&buf, armor.BLOCK_TYPE_SIGNATURE, nil, []byte("not a key")))
+	_, err := dearmorKeyring(&buf)
+	require.ErrorContains(t, err, armor.BLOCK_TYPE_SIGNATURE)
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "empty.deb")
+	require.NoError(t, os.WriteFile(path, []byte{}, 0644))
+	const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	const emptySHA512 = "cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e"
+	wrong := strings.Repeat("0", 64)
+
+	require.NoError(t, verifyChecksums(path, "", ""))
+	require.NoError(t, verifyChecksums(path, emptySHA256, ""))
+	require.NoError(t, verifyChecksums(path, "", emptySHA512))
+	require.NoError(t, verifyChecksums(path, emptySHA256, emptySHA512))
+
+	err := verifyChecksums(path, wrong, "")
+	require.ErrorContains(t, err, "expected sha256:"+wrong)
+	require.ErrorContains(t, err, "got sha256:"+emptySHA256)
+
+	err = verifyChecksums(path, emptySHA256, strings.Repeat("0", 128))
+	require.ErrorContains(t, err, "got sha512:"+emptySHA512)
+}
+
+func TestInspectDeb(t *testing.T) {
+	control, err := New(newFakeSystem()).inspectDeb(context.Background(), filepath.Join("..", "test_data", "debs", "adapt-test_1.0-1_all.deb"))
+	require.NoError(t, err)
+	require.Equal(t, "adapt-test 1.0-1 (all)", control.String())
+
+	_, err = New(newFakeSystem()).inspectDeb(context.Background(), filepath.Join("..", "test_data", "Aptfile"))
+	require.ErrorIs(t, err, deb.ErrNotDeb)
+}
+
+func TestInspectDebWithDpkgDeb(t *testing.T) {
+	if _, err := exec.LookPath("dpkg-deb"); err != nil {
+		t.Skip("dpkg-deb not available")
+	}
+	control, err := New(NewOSSystem(nil, "")).inspectDeb(context.Background(), filepath.Join("..", "test_data", "debs", "adapt-test-xz_1.0-1_s390x.deb"))
+	require.NoError(t, err)
+	require.Equal(t, "adapt-test 1.0-1 (s390x)", control.String())
+}
+
+func TestCheckDebArchitecture(t *testing.T) {
+	archs := []string{"amd64", "i386"}
+	require.NoError(t, checkDebArchitecture(&deb.Control{Package: "a", Architecture: "amd64"}, archs))
+	require.NoError(t, checkDebArchitecture(&deb.Control{Package: "a", Architecture: "i386"}, archs))
+	require.NoError(t, checkDebArchitecture(&deb.Control{Package: "a", Architecture: "all"}, archs))
+	err := checkDebArchitecture(&deb.Control{Package: "a", Architecture: "arm64"}, archs)
+	require.ErrorContains(t, err, "arm64")
+}
+
+func TestApplyDirectives(t *testing.T) {
+	aliceCert, err := os.ReadFile(filepath.Join("..", "test_data", "alice_cert.asc"))
+	require.NoError(t, err)
+	aliceInRelease, err := os.ReadFile(filepath.Join("..", "test_data", "repos", "alice", "dists", "stable", "InRelease"))
+	require.NoError(t, err)
+	aliceKeyring := readTestKeyring(t, "alice_cert.asc")
+	allDeb := filepath.Join("..", "test_data", "debs", "adapt-test_1.0-1_all.deb")
+	s390xDeb := filepath.Join("..", "test_data", "debs", "adapt-test_1.0-1_s390x.deb")
+	archCommands := []string{"dpkg --print-architecture", "dpkg --print-foreign-architectures"}
+	update := "apt-get update --yes"
+	install := "apt-get install --yes --no-install-recommends"
+
+	tests := []struct {
+		name         string
+		dirs         []any
+		dryRun       bool
+		setup        func(s *fakeSystem)
+		wantCommands []string
+		wantFiles    map[string]fakeFile
+		wantErr      string
+	}{
+		{
+			name: "packages",
+			dirs: []any{
+				aptfile.PackageDirective{Name: "curl"},
+				aptfile.PackageDirective{Name: "jq", Version: "1.6"},
+				aptfile.PackageDirective{Name: "fish", Release: "bookworm-backports"},
+			},
+			wantCommands: []string{update, install + " curl jq=1.6 fish/bookworm-backports"},
+		},
+		{
+			name: "unsigned source repo",
+			dirs: []any{
+				aptfile.RepoDirective{URL: "http://archive.ubuntu.com/ubuntu", Suite: "noble", Component: "main", IsSrc: true},
+			},
+			wantCommands: []string{update, install},
+			wantFiles: map[string]fakeFile{
+				"/etc/apt/sources.list.d/http_archive_ubuntu_com_ubuntu.list": {"deb-src http://archive.ubuntu.com/ubuntu noble main", 0644},
+			},
+		},
+		{
+			name: "signed repo",
+			dirs: []any{
+				aptfile.RepoDirective{URL: "https://alice.example.com", Suite: "stable", Component: "main", Arch: "amd64", SignedBy: "https://alice.example.com/key.asc"},
+			},
+			setup: func(s *fakeSystem) {
+				s.Responses["https://alice.example.com/key.asc"] = aliceCert
+				s.Responses["https://alice.example.com/dists/stable/InRelease"] = aliceInRelease
+			},
+			wantCommands: []string{update, install},
+			wantFiles: map[string]fakeFile{
+				"/usr/share/keyrings/https_alice_example_com.gpg":      {string(aliceKeyring), 0644},
+				"/etc/apt/sources.list.d/https_alice_example_com.list": {"deb [arch=amd64 signed-by=/usr/share/keyrings/https_alice_example_com.gpg] https://alice.example.com stable main", 0644},
+			},
+		},
+		{
+			name: "signed repo with missing key",
+			dirs: []any{
+				aptfile.RepoDirective{URL: "https://alice.example.com", Suite: "stable", Component: "main", SignedBy: "https://alice.example.com/key.asc"},
+			},
+			wantErr: "failed to download: error fetching key for https://alice.example.com",
+		},
+		{
+			name: "ppa",
+			dirs: []any{aptfile.PpaDirective{Name: "alice/tools"}},
+			setup: func(s *fakeSystem) {
+				s.Files[OS_RELEASE] = fakeFile{"ID=ubuntu\nVERSION_CODENAME=noble\n", 0644}
+				s.Responses[LAUNCHPAD_API+"/~alice/+archive/ubuntu/tools"] = []byte(`{"signing_key_fingerprint": "` + aliceFingerprint + `"}`)
+				s.Responses["https://keyserver.ubuntu.com/pks/lookup?op=get&options=mr&search=0x"+aliceFingerprint] = aliceCert
+				s.Responses[PPA_BASE_URL+"/alice/tools/ubuntu/dists/noble/InRelease"] = aliceInRelease
+			},
+			wantCommands: []string{update, install},
+			wantFiles: map[string]fakeFile{
+				"/usr/share/keyrings/alice-ubuntu-tools.gpg":      {string(aliceKeyring), 0644},
+				"/etc/apt/sources.list.d/alice-ubuntu-tools.list": {"deb [signed-by=/usr/share/keyrings/alice-ubuntu-tools.gpg] " + PPA_BASE_URL + "/alice/tools/ubuntu noble main", 0644},
+			},
+		},
+		{
+			name: "deb",
+			dirs: []any{aptfile.DebFileDirective{Path: allDeb}},
+			setup: func(s *fakeSystem) {
+				s.Outputs["dpkg --print-architecture"] = "amd64\n"
+			},
+			wantCommands: slices.Concat(archCommands, []string{"dpkg -i " + allDeb, update, install}),
+		},
+		{
+			name: "deb with missing dependencies",
+			dirs: []any{aptfile.DebFileDirective{Path: allDeb}},
+			setup: func(s *fakeSystem) {
+				s.Outputs["dpkg --print-architecture"] = "amd64\n"
+				s.Errors["dpkg -i "+allDeb] = errors.New("exit status 1")
+			},
+			wantCommands: slices.Concat(archCommands, []string{"dpkg -i " + allDeb, "apt-get install -f -y", update, install}),
+		},
+		{
+			name: "deb for foreign architecture",
+			dirs: []any{aptfile.DebFileDirective{Path: s390xDeb}},
+			setup: func(s *fakeSystem) {
+				s.Outputs["dpkg --print-architecture"] = "amd64\n"
+				s.Outputs["dpkg --print-foreign-architectures"] = "i386\n"
+			},
+			wantCommands: archCommands,
+			wantErr:      "is for architecture s390x, but this system supports amd64, i386",
+		},
+		{
+			name: "pin",
+			dirs: []any{
+				aptfile.PinDirective{PackageName: "nsight-compute", Priority: -1, Origin: "*ubuntu.com*"},
+				aptfile.PinDirective{PackageName: "*", Priority: 600, Release: "l=NVIDIA CUDA"},
+				aptfile.PinDirective{PackageName: "*", Priority: 100, Origin: `""`},
+			},
+			wantCommands: []string{update, install},
+			wantFiles: map[string]fakeFile{
+				"/etc/apt/preferences.d/adapt-nsight-compute-4b7c18ba.pref": {"Package: nsight-compute\nPin: origin *ubuntu.com*\nPin-Priority: -1\n", 0644},
+				"/etc/apt/preferences.d/adapt-all-8a1aa0d8.pref":            {"Package: *\nPin: release l=NVIDIA CUDA\nPin-Priority: 600\n", 0644},
+				"/etc/apt/preferences.d/adapt-all-31463984.pref":            {"Package: *\nPin: origin \"\"\nPin-Priority: 100\n", 0644},
+			},
+		},
+		{
+			name:         "hold",
+			dirs:         []any{aptfile.HoldDirective{PackageName: "docker-ce"}},
+			wantCommands: []string{"apt-mark hold docker-ce", update, install},
+		},
+		{
+			name: "hold at version",
+			dirs: []any{
+				aptfile.PackageDirective{Name: "curl"},
+				aptfile.HoldDirective{PackageName: "docker-ce", Version: "5:27.3.1-1"},
+				aptfile.UnholdDirective{PackageName: "containerd.io"},
+			},
+			setup: func(s *fakeSystem) {
+				s.Outputs["apt-mark showhold"] = "docker-ce\n"
+			},
+			wantCommands: []string{
+				"apt-mark unhold containerd.io",
+				"apt-mark showhold",
+				"apt-mark unhold docker-ce",
+				update,
+				install + " curl docker-ce=5:27.3.1-1",
+				"apt-mark hold docker-ce",
+			},
+		},
+		{
+			// apt-mark can't unhold a package apt doesn't know of before the update
+			name: "hold at version not yet held",
+			dirs: []any{aptfile.HoldDirective{PackageName: "docker-ce", Version: "5:27.3.1-1"}},
+			setup: func(s *fakeSystem) {
+				s.Errors["apt-mark unhold docker-ce"] = errors.New("exit status 100")
+			},
+			wantCommands: []string{
+				"apt-mark showhold",
+				update,
+				install + " docker-ce=5:27.3.1-1",
+				"apt-mark hold docker-ce",
+			},
+		},
+		{
+			name: "config",
+			dirs: []any{
+				aptfile.ConfigDirective{Key: aptfile.CONFIG_PROXY, Value: "http://proxy.example.com:3128"},
+				aptfile.ConfigDirective{Key: aptfile.CONFIG_CONFIGURE_APT, Value: "true"},
+			},
+			wantCommands: []string{update, install},
+			wantFiles: map[string]fakeFile{
+				APT_NETWORK_CONF: {"Acquire::http::Proxy \"http://proxy.example.com:3128\";\nAcquire::https::Proxy \"http://proxy.example.com:3128\";\n", 0644},
+			},
+		},
+		{
+			name: "config no longer configuring apt",
+			dirs: []any{aptfile.ConfigDirective{Key: aptfile.CONFIG_PROXY, Value: "http://proxy.example.com:3128"}},
+			setup: func(s *fakeSystem) {
+				s.Files[APT_NETWORK_CONF] = fakeFile{"Acquire::http::Proxy \"http://old-proxy.example.com:3128\";\n", 0644}
+			},
+			wantCommands: []string{update, install},
+			wantFiles: map[string]fakeFile{
+				APT_NETWORK_CONF: {"", 0644},
+			},
+		},
+		{
+			name: "debconf",
+			dirs: []any{
+				aptfile.PackageDirective{Name: "tzdata"},
+				aptfile.DebconfDirective{Package: "tzdata", Question: "tzdata/Areas", Type: "select", Value: "Etc"},
+			},
+			wantCommands: []string{"debconf-set-selections", update, install + " tzdata"},
+		},
+		{
+			name: "aptconf",
+			dirs: []any{
+				aptfile.PackageDirective{Name: "curl"},
+				aptfile.AptConfDirective{Key: "Acquire::Retries", Value: "3"},
+				aptfile.AptConfDirective{Key: "Dpkg::Options::", Value: "--force-confold"},
+			},
+			wantCommands: []string{update, install + " curl"},
+			wantFiles: map[string]fakeFile{
+				APT_CONF: {aptConfHeader + "Acquire::Retries \"3\";\nDpkg::Options:: \"--force-confold\";\n", 0644},
+			},
+		},
+		{
+			name: "aptconf removed",
+			dirs: []any{aptfile.PackageDirective{Name: "curl"}},
+			setup: func(s *fakeSystem) {
+				s.Files[APT_CONF] = fakeFile{aptConfHeader + "Acquire::Retries \"3\";\n", 0644}
+			},
+			wantCommands: []string{update, install + " curl"},
+			wantFiles: map[string]fakeFile{
+				APT_CONF: {aptConfHeader, 0644},
+			},
+		},
+		{
+			name: "dry run",
+			dirs: []any{
+				aptfile.PackageDirective{Name: "curl"},
+				aptfile.RepoDirective{URL: "https://alice.example.com", Suite: "stable", Component: "main", SignedBy: "https://alice.example.com/key.asc"},
+				aptfile.PpaDirective{Name: "fish-shell/release-4"},
+				aptfile.DebFileDirective{Path: "https://example.com/a.deb"},
+				aptfile.PinDirective{PackageName: "curl", Priority: 600, Version: "8.*"},
+				aptfile.HoldDirective{PackageName: "curl"},
+				aptfile.HoldDirective{PackageName: "docker-ce", Version: "5:27.3.1-1"},
+				aptfile.UnholdDirective{PackageName: "jq"},
+				aptfile.ConfigDirective{Key: aptfile.CONFIG_CONFIGURE_APT, Value: "true"},
+				aptfile.DebconfDirective{Package: "tzdata", Question: "tzdata/Areas", Type: "select", Value: "Etc"},
+				aptfile.AptConfDirective{Key: "Acquire::Retries", Value: "3"},
+			},
+			setup: func(s *fakeSystem) {
+				s.Files[OS_RELEASE] = fakeFile{"VERSION_CODENAME=noble\n", 0644}
+			},
+			// Only looks
+			wantCommands: []string{"apt-mark showhold"},
+			dryRun:       true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sys := newFakeSystem()
+			if tc.setup != nil {
+				tc.setup(sys)
+			}
+			existing := maps.Clone(sys.Files)
+			r := New(sys)
+			r.DryRun = tc.dryRun
+			err := r.Apply(context.Background(), tc.dirs)
+			if tc.wantErr != "" {
+				require.ErrorContains(t, err, tc.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+			if tc.wantCommands == nil {
+				tc.wantCommands = []string{}
+			}
+			require.Equal(t, tc.wantCommands, sys.CommandLines())
+			if tc.wantFiles == nil {
+				tc.wantFiles = map[string]fakeFile{}
+			}
+			maps.DeleteFunc(sys.Files, func(path string, f fakeFile) bool {
+				return existing[path] == f
+			})
+			require.Equal(t, tc.wantFiles, sys.Files)
+			if tc.dryRun {
+				require.Empty(t, sys.Requests)
+			}
+		})
+	}
+}
+
+func TestRunnerKeepsStateBetweenApplies(t *testing.T) {
+	sys := newFakeSystem()
+	r := New(sys)
+	ctx := context.Background()
+
+	require.NoError(t, r.Apply(ctx, []any{aptfile.PackageDirective{Name: "curl"}}))
+	require.NoError(t, r.Apply(ctx, []any{aptfile.PackageDirective{Name: "jq"}}))
+	require.NoError(t, r.Apply(ctx, []any{
+		aptfile.RepoDirective{URL: "http://archive.ubuntu.com/ubuntu", Suite: "noble", Component: "universe"},
+		aptfile.PackageDirective{Name: "fish"},
+	}))
+	require.Equal(t, []string{
+		"apt-get update --yes",
+		"apt-get install --yes --no-install-recommends curl",
+		"apt-get install --yes --no-install-recommends jq",
+		"apt-get update --yes",
+		"apt-get install --yes --no-install-recommends fish",
+	}, sys.CommandLines())
+}
+
+func TestApplyStopsWhenCancelled(t *testing.T) {
+	sys := newFakeSystem()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := New(sys).Apply(ctx, []any{aptfile.HoldDirective{PackageName: "curl"}})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Empty(t, sys.Commands)
+}
+
+func TestApplyReportsCompletedDirectivesWhenCancelled(t *testing.T) {
+	sys := newFakeSystem()
+	ctx, cancel := context.WithCancelCause(context.Background())
+	sys.OnRun = func(cmd Command) {
+		if cmd.String() == "apt-mark hold b" {
+			cancel(&SignalError{Signal: syscall.SIGTERM})
+		}
+	}
+	sys.Errors["apt-mark hold b"] = errors.New("signal: terminated")
+	dirs := []any{
+		aptfile.ConfigDirective{Key: aptfile.CONFIG_PROXY, Value: "http://proxy.example.com:3128"},
+		aptfile.PackageDirective{Name: "curl"},
+		aptfile.HoldDirective{PackageName: "a"},
+		aptfile.HoldDirective{PackageName: "b"},
+		aptfile.HoldDirective{PackageName: "c"},
+	}
+	err := New(sys).Apply(ctx, dirs)
+
+	var cancelled *CancelledError
+	require.ErrorAs(t, err, &cancelled)
+	require.Equal(t, []any{dirs[0], dirs[2]}, cancelled.Completed)
+	require.Equal(t, 5, cancelled.Total)
+	require.ErrorIs(t, err, context.Canceled)
+	var sigErr *SignalError
+	require.ErrorAs(t, err, &sigErr)
+	require.Equal(t, "cancelled (received terminated) after completing 2 of 5 directives", err.Error())
+	require.Equal(t, []string{"apt-mark hold a", "apt-mark hold b"}, sys.CommandLines())
+}
+
+func TestDescribe(t *testing.T) {
+	tests := []struct {
+		dir      any
+		expected string
+	}{
+		{aptfile.PackageDirective{Name: "jq", Version: "1.6"}, "package jq=1.6"},
+		{aptfile.PackageDirective{Name: "fish", Release: "noble-backports"}, "package fish/noble-backports"},
+		{aptfile.PpaDirective{Name: "fish-shell/release-4"}, "ppa fish-shell/release-4"},
+		{aptfile.RepoDirective{URL: "http://archive.ubuntu.com/ubuntu", Suite: "noble", Component: "main", IsSrc: true}, "repo-src http://archive.ubuntu.com/ubuntu noble main"},
+		{aptfile.RepoDirective{URL: "https://example.com/debian", Suite: "./"}, "repo https://example.com/debian ./"},
+		{aptfile.DebFileDirective{Path: "tool.deb"}, "deb tool.deb"},
+		{aptfile.PinDirective{PackageName: "curl"}, "pin curl"},
+		{aptfile.HoldDirective{PackageName: "curl"}, "hold curl"},
+		{aptfile.HoldDirective{PackageName: "curl", Version: "8.5.0"}, "hold curl=8.5.0"},
+		{aptfile.UnholdDirective{PackageName: "curl"}, "unhold curl"},
+		{aptfile.ConfigDirective{Key: "proxy"}, "config proxy"},
+		{aptfile.DebconfDirective{Package: "tzdata", Question: "tzdata/Areas", Type: "select", Value: "Etc"}, "debconf tzdata/Areas"},
+		{aptfile.AptConfDirective{Key: "Acquire::Retries", Value: "3"}, "aptconf Acquire::Retries"},
+	}
+	for _, tc := range tests {
+		require.Equal(t, tc.expected, Describe(tc.dir))
+	}
+}
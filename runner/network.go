@@ -0,0 +1,102 @@
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ericsuh/adapt/aptfile"
+)
+
+const APT_NETWORK_CONF = "/etc/apt/apt.conf.d/90adapt-network"
+
+// Network settings for adapt's own downloads, and optionally apt's
+type NetworkConfig struct {
+	Proxy  string
+	CAFile string
+	// Also write the proxy and CA settings to an apt.conf.d snippet
+	ConfigureApt bool
+}
+
+// Combine config directives from the Aptfile with command line flags.
+// Flags take precedence. A relative ca-file in the Aptfile is resolved
+// against the Aptfile's directory.
+func mergeNetworkConfig(dirs []any, cli NetworkConfig, aptfileDir string) NetworkConfig {
+	cfg := NetworkConfig{}
+	for _, d := range dirs {
+		dir, ok := d.(aptfile.ConfigDirective)
+		if !ok {
+			continue
+		}
+		switch dir.Key {
+		case aptfile.CONFIG_PROXY:
+			cfg.Proxy = dir.Value
+		case aptfile.CONFIG_CA_FILE:
+			cfg.CAFile = dir.Value
+			if !filepath.IsAbs(cfg.CAFile) {
+				cfg.CAFile = filepath.Join(aptfileDir, cfg.CAFile)
+			}
+		case aptfile.CONFIG_CONFIGURE_APT:
+			// Already validated by the parser
+			cfg.ConfigureApt, _ = strconv.ParseBool(dir.Value)
+		}
+	}
+	if cli.Proxy != "" {
+		cfg.Proxy = cli.Proxy
+	}
+	if cli.CAFile != "" {
+		cfg.CAFile = cli.CAFile
+	}
+	cfg.ConfigureApt = cfg.ConfigureApt || cli.ConfigureApt
+	return cfg
+}
+
+// Set up adapt's own downloads, and write APT_NETWORK_CONF if apt should
+// use the same settings. Otherwise an existing file is emptied, so that
+// apt doesn't keep using a proxy or CA that's no longer wanted.
+func (r *Runner) applyNetworkConfig(cfg NetworkConfig) error {
+	client := r.System.HTTP()
+	if cfg.Proxy != "" {
+		if err := client.SetProxy(cfg.Proxy); err != nil {
+			return err
+		}
+	}
+	if cfg.CAFile != "" {
+		if err := client.AddCAFile(cfg.CAFile); err != nil {
+			return err
+		}
+	}
+	content := ""
+	if cfg.ConfigureApt {
+		content = aptNetworkConf(cfg)
+	}
+	if content == "" {
+		if _, err := r.System.ReadFile(APT_NETWORK_CONF); errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	if r.DryRun {
+		fmt.Printf("[dry-run] Would write apt network settings to \"%s\"\n", APT_NETWORK_CONF)
+		return nil
+	}
+	fmt.Printf("Writing apt network settings to %s\n", APT_NETWORK_CONF)
+	return r.System.WriteFile(APT_NETWORK_CONF, []byte(content), 0644)
+}
+
+// apt.conf settings that make apt use the same proxy and CA as adapt
+func aptNetworkConf(cfg NetworkConfig) string {
+	var sb strings.Builder
+	if cfg.Proxy != "" {
+		fmt.Fprintf(&sb, "Acquire::http::Proxy \"%s\";\n", cfg.Proxy)
+		fmt.Fprintf(&sb, "Acquire::https::Proxy \"%s\";\n", cfg.Proxy)
+	}
+	if cfg.CAFile != "" {
+		fmt.Fprintf(&sb, "Acquire::https::CaInfo \"%s\";\n", cfg.CAFile)
+	}
+	return sb.String()
+}
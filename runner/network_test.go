@@ -0,0 +1,44 @@
+package runner
+
+import (
+	"testing"
+
+	"github.com/ericsuh/adapt/aptfile"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeNetworkConfig(t *testing.T) {
+	dirs := []any{
+		aptfile.ConfigDirective{Key: aptfile.CONFIG_PROXY, Value: "http://aptfile-proxy:3128"},
+		aptfile.ConfigDirective{Key: aptfile.CONFIG_CA_FILE, Value: "certs/ca.pem"},
+		aptfile.ConfigDirective{Key: aptfile.CONFIG_CONFIGURE_APT, Value: "true"},
+		aptfile.PackageDirective{Name: "curl"},
+	}
+
+	cfg := mergeNetworkConfig(dirs, NetworkConfig{}, "/srv/build")
+	require.Equal(t, NetworkConfig{
+		Proxy:        "http://aptfile-proxy:3128",
+		CAFile:       "/srv/build/certs/ca.pem",
+		ConfigureApt: true,
+	}, cfg)
+
+	cfg = mergeNetworkConfig(dirs, NetworkConfig{Proxy: "http://flag-proxy:8080", CAFile: "/etc/ca.pem"}, "/srv/build")
+	require.Equal(t, NetworkConfig{
+		Proxy:        "http://flag-proxy:8080",
+		CAFile:       "/etc/ca.pem",
+		ConfigureApt: true,
+	}, cfg)
+
+	cfg = mergeNetworkConfig(nil, NetworkConfig{Proxy: "http://flag-proxy:8080"}, "/srv/build")
+	require.Equal(t, NetworkConfig{Proxy: "http://flag-proxy:8080"}, cfg)
+}
+
+func TestAptNetworkConf(t *testing.T) {
+	require.Equal(t, "", aptNetworkConf(NetworkConfig{ConfigureApt: true}))
+	require.Equal(t,
+		"Acquire::http::Proxy \"http://proxy:3128\";\n"+
+			"Acquire::https::Proxy \"http://proxy:3128\";\n"+
+			"Acquire::https::CaInfo \"/etc/ca.pem\";\n",
+		aptNetworkConf(NetworkConfig{Proxy: "http://proxy:3128", CAFile: "/etc/ca.pem"}),
+	)
+}
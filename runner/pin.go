@@ -0,0 +1,94 @@
+package runner
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/ericsuh/adapt/aptfile"
+)
+
+const APT_PREFERENCES_DIR = "/etc/apt/preferences.d"
+
+// The Pin: value for a pin. The parser allows only one of version,
+// release and origin, since apt takes one Pin: line per stanza.
+func pinSelector(pin aptfile.PinDirective) string {
+	switch {
+	case pin.Version != "":
+		return "version " + pin.Version
+	case pin.Release != "":
+		return "release " + pin.Release
+	default:
+		return "origin " + pin.Origin
+	}
+}
+
+// The apt_preferences(5) stanza for a pin
+func pinStanza(pin aptfile.PinDirective) string {
+	var sb strings.Builder
+	if pin.Explanation != "" {
+		for _, line := range strings.Split(pin.Explanation, "\n") {
+			fmt.Fprintf(&sb, "Explanation: %s\n", line)
+		}
+	}
+	fmt.Fprintf(&sb, "Package: %s\nPin: %s\nPin-Priority: %d\n", pin.PackageName, pinSelector(pin), pin.Priority)
+	return sb.String()
+}
+
+// A file name for a pin that's the same every run, and different for any
+// two pins that differ in more than their explanation. apt ignores files
+// in preferences.d unless they end in .pref or have no extension.
+func pinFilename(pin aptfile.PinDirective) string {
+	name := sanitizeFilename(pin.PackageName)
+	if name == "" {
+		name = "all"
+	}
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s\n%d\n%s", pin.PackageName, pin.Priority, pinSelector(pin)))
+	return fmt.Sprintf("%s/adapt-%s-%s.pref", APT_PREFERENCES_DIR, name, hex.EncodeToString(sum[:4]))
+}
+
+// Remove pin files left by earlier runs for pins that are no longer in
+// the Aptfile, or have since changed, since apt would keep applying them
+func (r *Runner) removeStalePins(dirs []any) error {
+	wanted := make(map[string]bool)
+	for _, d := range dirs {
+		if pin, ok := d.(aptfile.PinDirective); ok {
+			wanted[pinFilename(pin)] = true
+		}
+	}
+	names, err := r.System.ReadDir(APT_PREFERENCES_DIR)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, name := range names {
+		pinFile := path.Join(APT_PREFERENCES_DIR, name)
+		if !strings.HasPrefix(name, "adapt-") || !strings.HasSuffix(name, ".pref") || wanted[pinFile] {
+			continue
+		}
+		if r.DryRun {
+			fmt.Printf("[dry-run] Would remove old pin file \"%s\"\n", pinFile)
+			continue
+		}
+		fmt.Printf("Removing old pin file %s\n", pinFile)
+		if err := r.System.Remove(pinFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Runner) addPinPreference(ctx context.Context, pin aptfile.PinDirective) error {
+	pinFile := pinFilename(pin)
+	if r.DryRun {
+		fmt.Printf("[dry-run] Would write pin file \"%s\"\n", pinFile)
+		return nil
+	}
+	return r.System.WriteFile(pinFile, []byte(pinStanza(pin)), 0644)
+}
@@ -0,0 +1,86 @@
+package runner
+
+import (
+	"context"
+	"path"
+	"testing"
+
+	"github.com/ericsuh/adapt/aptfile"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPinStanza(t *testing.T) {
+	pin := aptfile.PinDirective{
+		PackageName: "nvidia-* /^cuda-[0-9-]+$/",
+		Priority:    600,
+		Release:     "o=Ubuntu,a=noble-backports",
+		Explanation: "Prefer NVIDIA's builds\nover Ubuntu's",
+	}
+	require.Equal(t,
+		"Explanation: Prefer NVIDIA's builds\n"+
+			"Explanation: over Ubuntu's\n"+
+			"Package: nvidia-* /^cuda-[0-9-]+$/\n"+
+			"Pin: release o=Ubuntu,a=noble-backports\n"+
+			"Pin-Priority: 600\n",
+		pinStanza(pin))
+
+	pin.Release = ""
+	pin.Version = "12.*"
+	pin.Explanation = ""
+	require.Equal(t, "Package: nvidia-* /^cuda-[0-9-]+$/\nPin: version 12.*\nPin-Priority: 600\n", pinStanza(pin))
+}
+
+func TestPinFilename(t *testing.T) {
+	pin := aptfile.PinDirective{PackageName: "*", Priority: 600, Release: "l=NVIDIA CUDA"}
+	name := pinFilename(pin)
+	require.Regexp(t, `^/etc/apt/preferences\.d/adapt-all-[0-9a-f]{8}\.pref$`, name)
+
+	// The same every time, whatever the explanation
+	explained := pin
+	explained.Explanation = "Prefer NVIDIA's builds"
+	require.Equal(t, name, pinFilename(explained))
+
+	// Different for anything else
+	names := map[string]bool{name: true}
+	for _, other := range []aptfile.PinDirective{
+		{PackageName: "*", Priority: 500, Release: "l=NVIDIA CUDA"},
+		{PackageName: "*", Priority: 600, Release: "l=Docker CE"},
+		{PackageName: "*", Priority: 600, Origin: "l=NVIDIA CUDA"},
+		{PackageName: "cuda", Priority: 600, Release: "l=NVIDIA CUDA"},
+		{PackageName: "cuda*", Priority: 600, Release: "l=NVIDIA CUDA"},
+	} {
+		names[pinFilename(other)] = true
+	}
+	require.Len(t, names, 6)
+	require.Regexp(t, `/adapt-nvidia-[^/]*-[0-9a-f]{8}\.pref$`, pinFilename(aptfile.PinDirective{PackageName: "nvidia-* /^cuda-[0-9-]+$/", Priority: 600, Version: "12.*"}))
+}
+
+func TestRemoveStalePins(t *testing.T) {
+	pin := aptfile.PinDirective{PackageName: "curl", Priority: 600, Version: "8.*"}
+	current := pinFilename(pin)
+	// The same pin before its priority was changed, and one that was removed
+	changed := pinFilename(aptfile.PinDirective{PackageName: "curl", Priority: 500, Version: "8.*"})
+	removed := pinFilename(aptfile.PinDirective{PackageName: "*", Priority: 100, Origin: `""`})
+	// Not written by adapt
+	other := APT_PREFERENCES_DIR + "/cuda-repository-pin-600"
+
+	setup := func() *fakeSystem {
+		sys := newFakeSystem()
+		for _, f := range []string{current, changed, removed, other} {
+			sys.Files[f] = fakeFile{"Package: *\n", 0644}
+		}
+		return sys
+	}
+
+	sys := setup()
+	r := New(sys)
+	r.DryRun = true
+	require.NoError(t, r.Apply(context.Background(), []any{pin}))
+	require.Len(t, sys.Files, 4)
+
+	sys = setup()
+	require.NoError(t, New(sys).Apply(context.Background(), []any{pin}))
+	names, err := sys.ReadDir(APT_PREFERENCES_DIR)
+	require.NoError(t, err)
+	require.Equal(t, []string{path.Base(current), path.Base(other)}, names)
+}
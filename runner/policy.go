@@ -0,0 +1,168 @@
+package runner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ericsuh/adapt/aptfile"
+)
+
+// A package as apt-cache policy describes it
+type Policy struct {
+	// The name as apt-cache gives it, with an architecture if it's foreign
+	Package string
+	// Empty if not installed, or if there's no candidate
+	Installed string
+	Candidate string
+	// Every version apt knows of, most preferred first, with its priority
+	Versions []PolicyVersion
+}
+
+type PolicyVersion struct {
+	Version  string
+	Priority int
+}
+
+// What apt made of a pin
+type PinReport struct {
+	Pin aptfile.PinDirective
+	// The packages apt-cache policy found for the pin's patterns
+	Packages []PinnedPackage
+}
+
+type PinnedPackage struct {
+	Policy
+	// Versions given the pin's priority
+	Pinned []string
+}
+
+// Whether any version of any package got the pin's priority
+func (p PinReport) Matched() bool {
+	return slices.ContainsFunc(p.Packages, func(pkg PinnedPackage) bool {
+		return len(pkg.Pinned) > 0
+	})
+}
+
+// Ask apt what each pin in dirs does to the packages it covers. A "*"
+// pattern would cover every package apt knows of, so it stands for the
+// packages the Aptfile installs or holds instead. A version counts as
+// pinned if apt gives it the pin's priority, so a pin with the same
+// priority as a repo, like 500, can't be told apart from no pin at all.
+func (r *Runner) ExplainPins(ctx context.Context, dirs []any) ([]PinReport, error) {
+	listed := make([]string, 0)
+	for _, d := range dirs {
+		switch dir := d.(type) {
+		case aptfile.PackageDirective:
+			listed = append(listed, dir.Name)
+		case aptfile.HoldDirective:
+			listed = append(listed, dir.PackageName)
+		}
+	}
+
+	reports := make([]PinReport, 0)
+	for _, d := range dirs {
+		pin, ok := d.(aptfile.PinDirective)
+		if !ok {
+			continue
+		}
+		report := PinReport{Pin: pin, Packages: make([]PinnedPackage, 0)}
+		patterns := policyPatterns(pin.PackageName, listed)
+		if len(patterns) > 0 {
+			out, err := r.System.Output(ctx, Command{Name: "apt-cache", Args: append([]string{"policy"}, patterns...)})
+			if err != nil {
+				return nil, fmt.Errorf("error running apt-cache policy for %s: %w", pin.PackageName, err)
+			}
+			for _, policy := range parsePolicy(out) {
+				pkg := PinnedPackage{Policy: policy, Pinned: make([]string, 0)}
+				for _, v := range policy.Versions {
+					if v.Priority == int(pin.Priority) {
+						pkg.Pinned = append(pkg.Pinned, v.Version)
+					}
+				}
+				report.Packages = append(report.Packages, pkg)
+			}
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// The arguments to apt-cache policy for a pin's packages. apt-cache takes
+// globs and regular expressions too, but regular expressions without the
+// slashes pins use.
+func policyPatterns(packages string, listed []string) []string {
+	patterns := make([]string, 0)
+	for _, p := range strings.Fields(packages) {
+		switch {
+		case p == "*":
+			patterns = append(patterns, listed...)
+		case len(p) >= 2 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/"):
+			patterns = append(patterns, p[1:len(p)-1])
+		default:
+			patterns = append(patterns, p)
+		}
+	}
+	slices.Sort(patterns)
+	return slices.Compact(patterns)
+}
+
+// Parse the output of apt-cache policy for one or more packages, which
+// looks like:
+//
+//	curl:
+//	  Installed: 8.5.0-2ubuntu10.6
+//	  Candidate: 8.5.0-2ubuntu10.6
+//	  Version table:
+//	 *** 8.5.0-2ubuntu10.6 500
+//	        500 http://archive.ubuntu.com/ubuntu noble-updates/main amd64 Packages
+//	        100 /var/lib/dpkg/status
+//	     8.5.0-2ubuntu10 500
+//	        500 http://archive.ubuntu.com/ubuntu noble/main amd64 Packages
+func parsePolicy(out []byte) []Policy {
+	policies := make([]Policy, 0)
+	var current *Policy
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		switch {
+		case trimmed == "":
+			continue
+		case indent == 0 && strings.HasSuffix(line, ":"):
+			policies = append(policies, Policy{Package: strings.TrimSuffix(line, ":")})
+			current = &policies[len(policies)-1]
+		case current == nil:
+			continue
+		case strings.HasPrefix(trimmed, "Installed:"):
+			current.Installed = policyVersion(strings.TrimPrefix(trimmed, "Installed:"))
+		case strings.HasPrefix(trimmed, "Candidate:"):
+			current.Candidate = policyVersion(strings.TrimPrefix(trimmed, "Candidate:"))
+		case strings.HasPrefix(line, " *** ") || indent == 5:
+			// Sources for a version are indented further
+			fields := strings.Fields(strings.TrimPrefix(trimmed, "*** "))
+			if len(fields) != 2 {
+				continue
+			}
+			priority, err := strconv.Atoi(fields[1])
+			if err != nil {
+				continue
+			}
+			current.Versions = append(current.Versions, PolicyVersion{Version: fields[0], Priority: priority})
+		}
+	}
+	return policies
+}
+
+func policyVersion(s string) string {
+	s = strings.TrimSpace(s)
+	if s == "(none)" {
+		return ""
+	}
+	return s
+}
@@ -0,0 +1,91 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ericsuh/adapt/aptfile"
+	"github.com/stretchr/testify/require"
+)
+
+const testNsightPolicy = `nsight-compute:
+  Installed: (none)
+  Candidate: 2023.2.2.3~12.3.1-1
+  Version table:
+     2024.1.1.4~12.4.1-1 -1
+        500 http://archive.ubuntu.com/ubuntu noble/multiverse amd64 Packages
+     2023.2.2.3~12.3.1-1 500
+        500 https://developer.download.nvidia.com/compute/cuda/repos/ubuntu2404/x86_64  Packages
+`
+
+const testLibcPolicy = `libc6:i386:
+  Installed: 2.39-0ubuntu8.3
+  Candidate: 2.39-0ubuntu8.3
+  Version table:
+ *** 2.39-0ubuntu8.3 500
+        500 http://archive.ubuntu.com/ubuntu noble-updates/main i386 Packages
+        100 /var/lib/dpkg/status
+`
+
+func TestParsePolicy(t *testing.T) {
+	require.Equal(t, []Policy{
+		{
+			Package:   "nsight-compute",
+			Candidate: "2023.2.2.3~12.3.1-1",
+			Versions: []PolicyVersion{
+				{Version: "2024.1.1.4~12.4.1-1", Priority: -1},
+				{Version: "2023.2.2.3~12.3.1-1", Priority: 500},
+			},
+		},
+		{
+			Package:   "libc6:i386",
+			Installed: "2.39-0ubuntu8.3",
+			Candidate: "2.39-0ubuntu8.3",
+			Versions:  []PolicyVersion{{Version: "2.39-0ubuntu8.3", Priority: 500}},
+		},
+	}, parsePolicy([]byte(testNsightPolicy+testLibcPolicy)))
+	require.Empty(t, parsePolicy(nil))
+}
+
+func TestPolicyPatterns(t *testing.T) {
+	listed := []string{"curl", "cuda-toolkit-12-4"}
+	require.Equal(t, []string{"nsight-compute"}, policyPatterns("nsight-compute", listed))
+	require.Equal(t, []string{"^cuda-[0-9-]+$", "nvidia-*"}, policyPatterns("nvidia-* /^cuda-[0-9-]+$/", listed))
+	require.Equal(t, []string{"cuda-toolkit-12-4", "curl"}, policyPatterns("* curl", listed))
+	require.Empty(t, policyPatterns("*", nil))
+}
+
+func TestExplainPins(t *testing.T) {
+	dirs := []any{
+		aptfile.PackageDirective{Name: "curl"},
+		aptfile.PinDirective{PackageName: "nsight-compute", Priority: -1, Origin: "*ubuntu.com*"},
+		aptfile.PinDirective{PackageName: "*", Priority: 990, Release: "n=noble-proposed"},
+		aptfile.PinDirective{PackageName: "missing", Priority: 600, Version: "1.*"},
+	}
+	sys := newFakeSystem()
+	sys.Outputs["apt-cache policy nsight-compute"] = testNsightPolicy
+	sys.Outputs["apt-cache policy curl"] = "curl:\n  Installed: 8.5.0-2ubuntu10.6\n  Candidate: 8.5.0-2ubuntu10.6\n  Version table:\n *** 8.5.0-2ubuntu10.6 500\n        100 /var/lib/dpkg/status\n"
+
+	reports, err := New(sys).ExplainPins(context.Background(), dirs)
+	require.NoError(t, err)
+	require.Equal(t, []string{"apt-cache policy nsight-compute", "apt-cache policy curl", "apt-cache policy missing"}, sys.CommandLines())
+	require.Len(t, reports, 3)
+
+	require.True(t, reports[0].Matched())
+	require.Len(t, reports[0].Packages, 1)
+	require.Equal(t, []string{"2024.1.1.4~12.4.1-1"}, reports[0].Packages[0].Pinned)
+	require.Equal(t, "2023.2.2.3~12.3.1-1", reports[0].Packages[0].Candidate)
+
+	require.False(t, reports[1].Matched())
+	require.Len(t, reports[1].Packages, 1)
+	require.Equal(t, "curl", reports[1].Packages[0].Package)
+	require.Empty(t, reports[1].Packages[0].Pinned)
+
+	require.False(t, reports[2].Matched())
+	require.Empty(t, reports[2].Packages)
+
+	sys.Errors["apt-cache policy nsight-compute"] = errors.New("exit status 100")
+	_, err = New(sys).ExplainPins(context.Background(), dirs)
+	require.ErrorContains(t, err, "error running apt-cache policy for nsight-compute")
+}
@@ -0,0 +1,149 @@
+package runner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/ericsuh/adapt/aptfile"
+	"github.com/ericsuh/adapt/pgp"
+)
+
+const (
+	LAUNCHPAD_API        = "https://api.launchpad.net/1.0"
+	PPA_BASE_URL         = "https://ppa.launchpadcontent.net"
+	PRIVATE_PPA_BASE_URL = "https://private-ppa.launchpadcontent.net"
+	PPA_KEYSERVER        = "hkps://keyserver.ubuntu.com"
+	OS_RELEASE           = "/etc/os-release"
+)
+
+var ppaFingerprintRegex = regexp.MustCompile(`^[0-9A-F]{40}$`)
+
+// Split a PPA name like "deadsnakes/ppa" into its owner and name. A bare
+// owner means their PPA called "ppa".
+func splitPPA(ppa string) (string, string, error) {
+	owner, name, found := strings.Cut(strings.TrimPrefix(ppa, "ppa:"), "/")
+	if !found {
+		name = "ppa"
+	}
+	if owner == "" || name == "" || strings.Contains(name, "/") {
+		return "", "", fmt.Errorf(`invalid PPA "%s", expected "owner/name"`, ppa)
+	}
+	return owner, name, nil
+}
+
+// Work out the repo for a PPA: its URL, the series of the system being set
+// up unless the directive gives one, and the signing key fingerprint
+// according to Launchpad unless the directive gives that too. Private PPAs
+// are served from their own host, with credentials that are set on the
+// HTTP client here so that the repo can be verified. In dry-run mode
+// Launchpad isn't asked and credentials aren't read.
+func (r *Runner) resolvePPA(ctx context.Context, d aptfile.PpaDirective) (resolvedRepo, error) {
+	owner, name, err := splitPPA(d.Name)
+	if err != nil {
+		return resolvedRepo{}, err
+	}
+	series := d.Series
+	if series == "" {
+		series, err = r.distroSeries()
+		if err != nil {
+			return resolvedRepo{}, err
+		}
+	}
+	baseURL := r.PPABaseURL
+	if d.Auth != "" {
+		baseURL = r.PrivatePPABaseURL
+	}
+	repo := aptfile.RepoDirective{
+		URL:         fmt.Sprintf("%s/%s/%s/ubuntu", strings.TrimSuffix(baseURL, "/"), owner, name),
+		Suite:       series,
+		Component:   "main",
+		Keyserver:   r.PPAKeyserver,
+		Fingerprint: d.Fingerprint,
+	}
+	ppa := resolvedRepo{
+		repo:    repo,
+		name:    sanitizeFilename(fmt.Sprintf("%s-ubuntu-%s", owner, name)),
+		alsoSrc: d.IsSrc,
+	}
+	if d.Auth != "" {
+		ppa.auth, err = r.resolveAuth(d.Auth, repo.URL)
+		if err != nil {
+			return resolvedRepo{}, err
+		}
+	}
+	if r.DryRun {
+		if d.Fingerprint == "" {
+			fmt.Printf("[dry-run] Would look up signing key for PPA %s/%s on Launchpad\n", owner, name)
+		}
+	} else if d.Fingerprint == "" {
+		ppa.repo.Fingerprint, err = r.lookupPPAFingerprint(ctx, owner, name)
+		if err != nil {
+			return resolvedRepo{}, err
+		}
+	}
+	return ppa, nil
+}
+
+// Ask Launchpad for the fingerprint of the key a PPA is signed with
+func (r *Runner) lookupPPAFingerprint(ctx context.Context, owner string, name string) (string, error) {
+	api := fmt.Sprintf("%s/~%s/+archive/ubuntu/%s", strings.TrimSuffix(r.LaunchpadAPI, "/"), url.PathEscape(owner), url.PathEscape(name))
+	data, err := r.System.HTTP().Get(ctx, api)
+	if err != nil {
+		return "", fmt.Errorf("error looking up PPA %s/%s: %w", owner, name, err)
+	}
+	var archive struct {
+		SigningKeyFingerprint string `json:"signing_key_fingerprint"`
+	}
+	if err := json.Unmarshal(data, &archive); err != nil {
+		return "", fmt.Errorf("error reading Launchpad response for PPA %s/%s: %w", owner, name, err)
+	}
+	fingerprint := pgp.NormalizeFingerprint(archive.SigningKeyFingerprint)
+	if !ppaFingerprintRegex.MatchString(fingerprint) {
+		return "", fmt.Errorf(`PPA %s/%s has no usable signing key fingerprint (got "%s")`, owner, name, archive.SigningKeyFingerprint)
+	}
+	return fingerprint, nil
+}
+
+// The release codename of the system being set up, like "noble". Ubuntu
+// derivatives set UBUNTU_CODENAME to the Ubuntu release they're based on,
+// which is the one PPAs are built for.
+func (r *Runner) distroSeries() (string, error) {
+	data, err := r.System.ReadFile(OS_RELEASE)
+	if err != nil {
+		return "", fmt.Errorf("error finding distribution series: %w", err)
+	}
+	fields := parseOSRelease(data)
+	for _, key := range []string{"UBUNTU_CODENAME", "VERSION_CODENAME"} {
+		if fields[key] != "" {
+			return fields[key], nil
+		}
+	}
+	return "", fmt.Errorf("no codename in %s", OS_RELEASE)
+}
+
+// Parse the KEY=value lines of os-release(5), unquoting values
+func parseOSRelease(data []byte) map[string]string {
+	fields := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		fields[key] = value
+	}
+	return fields
+}
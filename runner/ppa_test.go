@@ -0,0 +1,193 @@
+package runner
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ericsuh/adapt/aptfile"
+	"github.com/stretchr/testify/require"
+)
+
+// A stand-in for Launchpad that knows about one PPA, alice/tools, along
+// with the keyserver it's signed with and the PPA itself, both public and
+// private. The private one needs the login "bob" and password "s3cret".
+func newTestLaunchpad(t *testing.T, fingerprint string) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/1.0/~alice/+archive/ubuntu/tools", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"name": "tools", "signing_key_fingerprint": "` + fingerprint + `"}`))
+	})
+	mux.HandleFunc("/pks/lookup", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("search") != "0x"+aliceFingerprint {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join("..", "test_data", "alice_cert.asc"))
+	})
+	mux.HandleFunc("/ppa/alice/tools/ubuntu/dists/jammy/InRelease", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, filepath.Join("..", "test_data", "repos", "alice", "dists", "stable", "InRelease"))
+	})
+	mux.HandleFunc("/private/alice/tools/ubuntu/dists/jammy/InRelease", func(w http.ResponseWriter, r *http.Request) {
+		if login, password, ok := r.BasicAuth(); !ok || login != "bob" || password != "s3cret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join("..", "test_data", "repos", "alice", "dists", "stable", "InRelease"))
+	})
+	return httptest.NewServer(mux)
+}
+
+func newTestPPARunner(server *httptest.Server, sys *fakeSystem) *Runner {
+	sys.client = testDownloader(server)
+	r := New(sys)
+	r.LaunchpadAPI = server.URL + "/1.0"
+	r.PPABaseURL = server.URL + "/ppa"
+	r.PrivatePPABaseURL = server.URL + "/private"
+	r.PPAKeyserver = server.URL
+	return r
+}
+
+func TestApplyPPA(t *testing.T) {
+	server := newTestLaunchpad(t, strings.ToLower(aliceFingerprint))
+	defer server.Close()
+	sys := newFakeSystem()
+	// An Ubuntu derivative, which should get the Ubuntu series
+	sys.Files[OS_RELEASE] = fakeFile{"ID=pop\nVERSION_CODENAME=jammy-pop\nUBUNTU_CODENAME=jammy\n", 0644}
+
+	err := newTestPPARunner(server, sys).Apply(context.Background(), []any{aptfile.PpaDirective{Name: "alice/tools"}})
+	require.NoError(t, err)
+	require.Equal(t, readTestKeyring(t, "alice_cert.asc"), []byte(sys.Files["/usr/share/keyrings/alice-ubuntu-tools.gpg"].Data))
+	require.Equal(t,
+		"deb [signed-by=/usr/share/keyrings/alice-ubuntu-tools.gpg] "+server.URL+"/ppa/alice/tools/ubuntu jammy main",
+		sys.Files["/etc/apt/sources.list.d/alice-ubuntu-tools.list"].Data)
+	require.Equal(t, []string{"apt-get update --yes", "apt-get install --yes --no-install-recommends"}, sys.CommandLines())
+}
+
+func TestApplyPrivatePPA(t *testing.T) {
+	// Launchpad won't say what a private PPA is signed with, so it's given
+	server := newTestLaunchpad(t, "")
+	defer server.Close()
+	sys := newFakeSystem()
+	// A jammy PPA on a newer release
+	sys.Files[OS_RELEASE] = fakeFile{"VERSION_CODENAME=noble\n", 0644}
+	t.Setenv("ADAPT_TEST_PPA_AUTH", "bob:s3cret")
+
+	dir := aptfile.PpaDirective{Name: "alice/tools", Series: "jammy", IsSrc: true, Auth: "env:ADAPT_TEST_PPA_AUTH", Fingerprint: aliceFingerprint}
+	err := newTestPPARunner(server, sys).Apply(context.Background(), []any{dir})
+	require.NoError(t, err)
+	machine := strings.TrimPrefix(server.URL, "http://") + "/private/alice/tools/ubuntu"
+	require.Equal(t, fakeFile{"machine " + machine + "\nlogin bob\npassword s3cret\n", 0600}, sys.Files[APT_AUTH_DIR+"/alice-ubuntu-tools.conf"])
+	repoURL := server.URL + "/private/alice/tools/ubuntu"
+	require.Equal(t,
+		"deb [signed-by=/usr/share/keyrings/alice-ubuntu-tools.gpg] "+repoURL+" jammy main\n"+
+			"deb-src [signed-by=/usr/share/keyrings/alice-ubuntu-tools.gpg] "+repoURL+" jammy main",
+		sys.Files["/etc/apt/sources.list.d/alice-ubuntu-tools.list"].Data)
+	for _, line := range sys.CommandLines() {
+		require.NotContains(t, line, "s3cret")
+	}
+}
+
+func TestApplyPrivatePPAErrors(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "wrong"), []byte("bob:hunter2\n"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "malformed"), []byte("bob\n"), 0600))
+	tests := []struct {
+		name    string
+		auth    string
+		wantErr string
+	}{
+		{name: "unset variable", auth: "env:ADAPT_TEST_UNSET", wantErr: "environment variable ADAPT_TEST_UNSET for credentials is not set"},
+		{name: "missing file", auth: "file:missing", wantErr: "error reading credentials"},
+		{name: "malformed", auth: "file:malformed", wantErr: `credentials from file:malformed must look like "login:password"`},
+		{name: "wrong password", auth: "file:wrong", wantErr: "401 Unauthorized"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newTestLaunchpad(t, "")
+			defer server.Close()
+			sys := newFakeSystem()
+			r := newTestPPARunner(server, sys)
+			r.Dir = dir
+
+			err := r.Apply(context.Background(), []any{aptfile.PpaDirective{Name: "alice/tools", Series: "jammy", Auth: tc.auth, Fingerprint: aliceFingerprint}})
+			require.ErrorContains(t, err, tc.wantErr)
+			require.NotContains(t, err.Error(), "hunter2")
+			require.Empty(t, sys.Commands)
+		})
+	}
+}
+
+func TestApplyPPAErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		ppa         string
+		fingerprint string
+		osRelease   string
+		wantErr     string
+	}{
+		{name: "unknown PPA", ppa: "alice/nothing", fingerprint: aliceFingerprint, osRelease: "VERSION_CODENAME=jammy\n", wantErr: "404 Not Found"},
+		{name: "no signing key", ppa: "alice/tools", fingerprint: "", osRelease: "VERSION_CODENAME=jammy\n", wantErr: "no usable signing key fingerprint"},
+		{name: "wrong key", ppa: "alice/tools", fingerprint: bobFingerprint, osRelease: "VERSION_CODENAME=jammy\n", wantErr: "404 Not Found"},
+		{name: "no codename", ppa: "alice/tools", fingerprint: aliceFingerprint, osRelease: "ID=debian\n", wantErr: "no codename in /etc/os-release"},
+		{name: "bad name", ppa: "alice/tools/extra", fingerprint: aliceFingerprint, osRelease: "VERSION_CODENAME=jammy\n", wantErr: `invalid PPA "alice/tools/extra"`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newTestLaunchpad(t, tc.fingerprint)
+			defer server.Close()
+			sys := newFakeSystem()
+			sys.Files[OS_RELEASE] = fakeFile{tc.osRelease, 0644}
+
+			err := newTestPPARunner(server, sys).Apply(context.Background(), []any{aptfile.PpaDirective{Name: tc.ppa}})
+			require.ErrorContains(t, err, tc.wantErr)
+			require.Empty(t, sys.Commands)
+		})
+	}
+}
+
+func TestSplitPPA(t *testing.T) {
+	tests := []struct {
+		input   string
+		owner   string
+		name    string
+		wantErr bool
+	}{
+		{input: "deadsnakes/ppa", owner: "deadsnakes", name: "ppa"},
+		{input: "ppa:fish-shell/release-4", owner: "fish-shell", name: "release-4"},
+		{input: "git-core", owner: "git-core", name: "ppa"},
+		{input: "/ppa", wantErr: true},
+		{input: "a/b/c", wantErr: true},
+	}
+	for _, tc := range tests {
+		owner, name, err := splitPPA(tc.input)
+		if tc.wantErr {
+			require.Error(t, err, tc.input)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, tc.owner, owner)
+		require.Equal(t, tc.name, name)
+	}
+}
+
+func TestParseOSRelease(t *testing.T) {
+	fields := parseOSRelease([]byte(`# comment
+NAME="Ubuntu"
+VERSION_ID='24.04'
+VERSION_CODENAME=noble
+
+PRETTY_NAME="Ubuntu 24.04 LTS"
+`))
+	require.Equal(t, map[string]string{
+		"NAME":             "Ubuntu",
+		"VERSION_ID":       "24.04",
+		"VERSION_CODENAME": "noble",
+		"PRETTY_NAME":      "Ubuntu 24.04 LTS",
+	}, fields)
+}
@@ -0,0 +1,134 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ericsuh/adapt/aptfile"
+	"github.com/ericsuh/adapt/download"
+)
+
+const DEFAULT_JOBS = 4
+
+// Key data fetched ahead of time for a repo directive
+type fetchedKey struct {
+	data        []byte
+	fingerprint string
+}
+
+// Everything downloaded before the apply phase, keyed by the index of the
+// directive that needs it
+type prefetched struct {
+	keys     map[int]fetchedKey
+	debs     map[int]string
+	releases []func()
+	mu       sync.Mutex
+}
+
+// Let go of downloaded .deb files that aren't kept in the cache
+func (p *prefetched) release() {
+	for _, release := range p.releases {
+		release()
+	}
+	p.releases = nil
+}
+
+// Download every repo key and remote .deb in dirs, at most jobs at a
+// time, so the apply phase doesn't wait on the network one directive at a
+// time. Progress lines are printed up front in directive order so the
+// output doesn't depend on which download finishes first. Once a download
+// fails or ctx is cancelled no new ones are started, those already running
+// are cancelled, and the error is returned once they have stopped.
+func prefetch(ctx context.Context, client *download.Client, dirs []any, jobs int) (*prefetched, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	p := &prefetched{
+		keys: make(map[int]fetchedKey),
+		debs: make(map[int]string),
+	}
+	queue := make([]func(p *prefetched) error, 0)
+	for i, d := range dirs {
+		switch dir := d.(type) {
+		case aptfile.RepoDirective:
+			if dir.SignedBy == "" && dir.Keyserver == "" {
+				continue
+			}
+			fmt.Printf("Downloading GPG key from: %s\n", keySource(dir))
+			queue = append(queue, func(p *prefetched) error {
+				data, fingerprint, err := fetchRepoKeyData(ctx, client, dir)
+				if err != nil {
+					return fmt.Errorf("error fetching key for %s: %w", dir.URL, err)
+				}
+				p.mu.Lock()
+				defer p.mu.Unlock()
+				p.keys[i] = fetchedKey{data, fingerprint}
+				return nil
+			})
+		case aptfile.DebFileDirective:
+			if !strings.HasPrefix(dir.Path, "http://") && !strings.HasPrefix(dir.Path, "https://") {
+				continue
+			}
+			fmt.Printf("Downloading .deb from: %s\n", dir.Path)
+			queue = append(queue, func(p *prefetched) error {
+				path, release, err := client.GetFile(ctx, dir.Path, dir.SHA256)
+				if err != nil {
+					return fmt.Errorf("error downloading %s: %w", dir.Path, err)
+				}
+				p.mu.Lock()
+				defer p.mu.Unlock()
+				p.debs[i] = path
+				p.releases = append(p.releases, release)
+				return nil
+			})
+		}
+	}
+
+	if jobs < 1 {
+		jobs = 1
+	}
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	failed := make(chan struct{})
+	slots := make(chan struct{}, jobs)
+dispatch:
+	for _, job := range queue {
+		select {
+		case <-failed:
+			break dispatch
+		case <-ctx.Done():
+			break dispatch
+		case slots <- struct{}{}:
+		}
+		// Something may have failed while waiting for the slot
+		select {
+		case <-failed:
+			break dispatch
+		default:
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := job(p); err != nil {
+				once.Do(func() {
+					firstErr = err
+					close(failed)
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	if firstErr != nil {
+		p.release()
+		return nil, firstErr
+	}
+	return p, nil
+}
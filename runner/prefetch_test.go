@@ -0,0 +1,122 @@
+package runner
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ericsuh/adapt/aptfile"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefetch(t *testing.T) {
+	var running, maxRunning atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		switch filepath.Ext(r.URL.Path) {
+		case ".asc":
+			http.ServeFile(w, r, filepath.Join("..", "test_data", "alice_cert.asc"))
+		case ".deb":
+			http.ServeFile(w, r, filepath.Join("..", "test_data", "debs", "adapt-test_1.0-1_all.deb"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	dirs := []any{
+		aptfile.RepoDirective{URL: "https://one.example.com", SignedBy: server.URL + "/one.asc", Fingerprint: aliceFingerprint},
+		aptfile.PackageDirective{Name: "curl"},
+		aptfile.DebFileDirective{Path: server.URL + "/one.deb"},
+		aptfile.RepoDirective{URL: "https://two.example.com", SignedBy: server.URL + "/two.asc"},
+		aptfile.RepoDirective{URL: "https://unsigned.example.com"},
+		aptfile.DebFileDirective{Path: server.URL + "/two.deb"},
+		aptfile.DebFileDirective{Path: "/tmp/local.deb"},
+		aptfile.RepoDirective{URL: "https://three.example.com", SignedBy: server.URL + "/three.asc"},
+	}
+	fetched, err := prefetch(context.Background(), testDownloader(server), dirs, 2)
+	require.NoError(t, err)
+	defer fetched.release()
+
+	require.LessOrEqual(t, maxRunning.Load(), int32(2))
+	require.Len(t, fetched.keys, 3)
+	for _, i := range []int{0, 3, 7} {
+		keyring, err := decodeRepoKey(fetched.keys[i].data, fetched.keys[i].fingerprint)
+		require.NoError(t, err)
+		require.NotEmpty(t, keyring)
+	}
+	require.Equal(t, aliceFingerprint, fetched.keys[0].fingerprint)
+	require.Len(t, fetched.debs, 2)
+	for _, i := range []int{2, 5} {
+		_, err := os.Stat(fetched.debs[i])
+		require.NoError(t, err)
+	}
+}
+
+func TestPrefetchFailsFast(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	var requests atomic.Int32
+	slowStarted := make(chan struct{})
+	slowCancelled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch r.URL.Path {
+		case "/slow.deb":
+			// Still running when the key download fails
+			close(slowStarted)
+			select {
+			case <-r.Context().Done():
+				close(slowCancelled)
+			case <-time.After(10 * time.Second):
+			}
+			return
+		case "/missing.asc":
+			<-slowStarted
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join("..", "test_data", "debs", "adapt-test_1.0-1_all.deb"))
+	}))
+	defer server.Close()
+
+	dirs := []any{
+		aptfile.DebFileDirective{Path: server.URL + "/one.deb"},
+		aptfile.DebFileDirective{Path: server.URL + "/slow.deb"},
+		aptfile.RepoDirective{URL: "https://missing.example.com", SignedBy: server.URL + "/missing.asc"},
+	}
+	for i := 0; i < 10; i++ {
+		dirs = append(dirs, aptfile.DebFileDirective{Path: server.URL + "/more.deb"})
+	}
+	client := testDownloader(server)
+	start := time.Now()
+	_, err := prefetch(context.Background(), client, dirs, 2)
+	require.ErrorContains(t, err, "error fetching key for https://missing.example.com")
+	require.ErrorContains(t, err, "404")
+	require.Equal(t, int32(3), requests.Load())
+
+	// The slow download was cancelled rather than waited for
+	require.Less(t, time.Since(start), 5*time.Second)
+	select {
+	case <-slowCancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow download was not cancelled")
+	}
+
+	// Downloads that had finished are cleaned up
+	entries, err := os.ReadDir(os.Getenv("TMPDIR"))
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
@@ -0,0 +1,187 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/ericsuh/adapt/download"
+)
+
+// A command for a System to run
+type Command struct {
+	Name string
+	Args []string
+	// Extra environment variables, added to adapt's own
+	Env []string
+	// Fed to the command's standard input. It isn't part of String, so it
+	// can hold things that shouldn't be shown.
+	Stdin []byte
+}
+
+func (c Command) String() string {
+	return strings.Join(append([]string{c.Name}, c.Args...), " ")
+}
+
+// Everything adapt does to the machine it runs on goes through a System:
+// running commands, writing files and downloading. Tests use a fake one to
+// check what would be done without doing it.
+type System interface {
+	// Run a command, passing its output through to ours. If ctx is
+	// cancelled the command is signalled and waited for, not killed.
+	Run(ctx context.Context, cmd Command) error
+	// Run a command and return its standard output
+	Output(ctx context.Context, cmd Command) ([]byte, error)
+	ReadFile(path string) ([]byte, error)
+	WriteFile(path string, data []byte, perm os.FileMode) error
+	// The names of the entries in a directory, sorted
+	ReadDir(path string) ([]string, error)
+	Remove(path string) error
+	// Make a local file available to commands, returning the path they
+	// should use for it and a function to call once they're done with it
+	Stage(path string) (string, func(), error)
+	// The client used for all of adapt's own downloads
+	HTTP() *download.Client
+}
+
+// The real System. If root is set, it acts on the system installed there
+// instead of this one: files are written under it and commands are run
+// in a chroot.
+type osSystem struct {
+	client *download.Client
+	root   string
+}
+
+func NewOSSystem(client *download.Client, root string) System {
+	return &osSystem{client: client, root: root}
+}
+
+// The cancellation cause when adapt is stopped by a signal, so that the
+// same signal can be passed on to running commands
+type SignalError struct {
+	Signal os.Signal
+}
+
+func (e *SignalError) Error() string {
+	return fmt.Sprintf("received %v", e.Signal)
+}
+
+func (s *osSystem) command(ctx context.Context, cmd Command) *exec.Cmd {
+	c := exec.CommandContext(ctx, cmd.Name, cmd.Args...)
+	if s.root != "" {
+		c = exec.CommandContext(ctx, "chroot", append([]string{s.root, cmd.Name}, cmd.Args...)...)
+	}
+	// Killing apt or dpkg part way through can leave a mess, so pass the
+	// signal on and let them clean up. Cmd.Wait then waits for them to exit.
+	c.Cancel = func() error {
+		var sig os.Signal = syscall.SIGTERM
+		var sigErr *SignalError
+		if errors.As(context.Cause(ctx), &sigErr) {
+			sig = sigErr.Signal
+		}
+		return c.Process.Signal(sig)
+	}
+	if len(cmd.Env) > 0 {
+		c.Env = append(os.Environ(), cmd.Env...)
+	}
+	if cmd.Stdin != nil {
+		c.Stdin = bytes.NewReader(cmd.Stdin)
+	}
+	return c
+}
+
+func (s *osSystem) Run(ctx context.Context, cmd Command) error {
+	c := s.command(ctx, cmd)
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	return c.Run()
+}
+
+func (s *osSystem) Output(ctx context.Context, cmd Command) ([]byte, error) {
+	return s.command(ctx, cmd).Output()
+}
+
+func (s *osSystem) ReadFile(path string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.root, path))
+}
+
+// Unlike os.WriteFile, an existing file gets perm too, before anything is
+// written to it, so that credentials are never left readable
+func (s *osSystem) WriteFile(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(filepath.Join(s.root, path), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *osSystem) ReadDir(path string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.root, path))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name()
+	}
+	return names, nil
+}
+
+func (s *osSystem) Remove(path string) error {
+	return os.Remove(filepath.Join(s.root, path))
+}
+
+// Files outside the root can't be seen from the chroot, so they are copied
+// into its /tmp
+func (s *osSystem) Stage(path string) (string, func(), error) {
+	if s.root == "" {
+		return path, func() {}, nil
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer func() {
+		if err2 := src.Close(); err2 != nil {
+			log.Printf("Error closing file: %v", err2)
+		}
+	}()
+	dst, err := os.CreateTemp(filepath.Join(s.root, "tmp"), "adapt-*"+filepath.Ext(path))
+	if err != nil {
+		return "", nil, err
+	}
+	remove := func() {
+		if err := os.Remove(dst.Name()); err != nil {
+			log.Printf("Error removing %s: %v", dst.Name(), err)
+		}
+	}
+	_, err = io.Copy(dst, src)
+	if err2 := dst.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		remove()
+		return "", nil, err
+	}
+	return filepath.Join("/tmp", filepath.Base(dst.Name())), remove, nil
+}
+
+func (s *osSystem) HTTP() *download.Client {
+	return s.client
+}
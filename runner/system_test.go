@@ -0,0 +1,218 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ericsuh/adapt/download"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeFile struct {
+	Data string
+	Perm os.FileMode
+}
+
+// A System that records what it is asked to do instead of doing it.
+// Commands succeed and print nothing unless given an entry in Outputs or
+// Errors, keyed by the command line. Downloads are served from Responses,
+// keyed by URL, and anything else is a 404.
+type fakeSystem struct {
+	Commands  []Command
+	Files     map[string]fakeFile
+	Requests  []string
+	Outputs   map[string]string
+	Errors    map[string]error
+	Responses map[string][]byte
+	// Called for each command before it returns
+	OnRun  func(cmd Command)
+	client *download.Client
+	mu     sync.Mutex
+}
+
+func newFakeSystem() *fakeSystem {
+	s := &fakeSystem{
+		Files:     make(map[string]fakeFile),
+		Outputs:   make(map[string]string),
+		Errors:    make(map[string]error),
+		Responses: make(map[string][]byte),
+	}
+	s.client = &download.Client{HTTP: &http.Client{Transport: s}}
+	return s
+}
+
+// The command lines run, in order
+func (s *fakeSystem) CommandLines() []string {
+	lines := make([]string, len(s.Commands))
+	for i, cmd := range s.Commands {
+		lines[i] = cmd.String()
+	}
+	return lines
+}
+
+func (s *fakeSystem) Run(ctx context.Context, cmd Command) error {
+	s.Commands = append(s.Commands, cmd)
+	if s.OnRun != nil {
+		s.OnRun(cmd)
+	}
+	return s.Errors[cmd.String()]
+}
+
+func (s *fakeSystem) Output(ctx context.Context, cmd Command) ([]byte, error) {
+	s.Commands = append(s.Commands, cmd)
+	return []byte(s.Outputs[cmd.String()]), s.Errors[cmd.String()]
+}
+
+func (s *fakeSystem) ReadFile(path string) ([]byte, error) {
+	f, ok := s.Files[path]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: path, Err: fs.ErrNotExist}
+	}
+	return []byte(f.Data), nil
+}
+
+func (s *fakeSystem) WriteFile(path string, data []byte, perm os.FileMode) error {
+	s.Files[path] = fakeFile{string(data), perm}
+	return nil
+}
+
+func (s *fakeSystem) ReadDir(path string) ([]string, error) {
+	names := make([]string, 0)
+	for p := range s.Files {
+		if dir, name := filepath.Split(p); filepath.Clean(dir) == path {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, &fs.PathError{Op: "open", Path: path, Err: fs.ErrNotExist}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func (s *fakeSystem) Remove(path string) error {
+	if _, ok := s.Files[path]; !ok {
+		return &fs.PathError{Op: "remove", Path: path, Err: fs.ErrNotExist}
+	}
+	delete(s.Files, path)
+	return nil
+}
+
+func (s *fakeSystem) Stage(path string) (string, func(), error) {
+	return path, func() {}, nil
+}
+
+func (s *fakeSystem) HTTP() *download.Client {
+	return s.client
+}
+
+func (s *fakeSystem) RoundTrip(r *http.Request) (*http.Response, error) {
+	// Downloads happen concurrently
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Requests = append(s.Requests, r.URL.String())
+	body, ok := s.Responses[r.URL.String()]
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     make(http.Header),
+		Body:       io.NopCloser(bytes.NewReader(body)),
+		Request:    r,
+	}
+	if !ok {
+		resp.StatusCode = http.StatusNotFound
+		resp.Status = "404 Not Found"
+	}
+	return resp, nil
+}
+
+func TestCommandString(t *testing.T) {
+	cmd := Command{Name: "apt-get", Args: []string{"install", "--yes", "curl"}, Env: []string{"A=b"}}
+	require.Equal(t, "apt-get install --yes curl", cmd.String())
+}
+
+func TestOSSystem(t *testing.T) {
+	sys := NewOSSystem(nil, "")
+	out, err := sys.Output(context.Background(), Command{Name: "sh", Args: []string{"-c", "echo $ADAPT_TEST"}, Env: []string{"ADAPT_TEST=hello"}})
+	require.NoError(t, err)
+	require.Equal(t, "hello\n", string(out))
+
+	out, err = sys.Output(context.Background(), Command{Name: "cat", Stdin: []byte("from stdin")})
+	require.NoError(t, err)
+	require.Equal(t, "from stdin", string(out))
+
+	require.Error(t, sys.Run(context.Background(), Command{Name: "sh", Args: []string{"-c", "exit 3"}}))
+
+	path := t.TempDir() + "/file"
+	require.NoError(t, sys.WriteFile(path, []byte("data"), 0600))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// An existing file is tightened too
+	require.NoError(t, os.Chmod(path, 0644))
+	require.NoError(t, sys.WriteFile(path, []byte("secret"), 0600))
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestOSSystemRoot(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"etc/apt", "tmp"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0755))
+	}
+	sys := NewOSSystem(nil, root).(*osSystem)
+
+	cmd := sys.command(context.Background(), Command{Name: "apt-get", Args: []string{"update", "--yes"}})
+	require.Equal(t, []string{"chroot", root, "apt-get", "update", "--yes"}, cmd.Args)
+
+	require.NoError(t, sys.WriteFile("/etc/apt/test.list", []byte("deb x"), 0644))
+	content, err := os.ReadFile(filepath.Join(root, "etc/apt/test.list"))
+	require.NoError(t, err)
+	require.Equal(t, "deb x", string(content))
+
+	content, err = sys.ReadFile("/etc/apt/test.list")
+	require.NoError(t, err)
+	require.Equal(t, "deb x", string(content))
+
+	deb := filepath.Join("..", "test_data", "debs", "adapt-test_1.0-1_all.deb")
+	staged, done, err := sys.Stage(deb)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(staged, "/tmp/adapt-"), staged)
+	require.True(t, strings.HasSuffix(staged, ".deb"), staged)
+	original, err := os.ReadFile(deb)
+	require.NoError(t, err)
+	copied, err := os.ReadFile(filepath.Join(root, staged))
+	require.NoError(t, err)
+	require.Equal(t, original, copied)
+	done()
+	_, err = os.Stat(filepath.Join(root, staged))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestOSSystemForwardsSignal(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	go func() {
+		// Give the shell time to set its trap
+		time.Sleep(100 * time.Millisecond)
+		cancel(&SignalError{Signal: os.Interrupt})
+	}()
+	out, err := NewOSSystem(nil, "").Output(ctx, Command{
+		Name: "sh",
+		Args: []string{"-c", `trap 'kill $!; echo cleaned up; exit 0' INT; sleep 5 >/dev/null & wait; echo not interrupted`},
+	})
+	// The command still reports cancellation even though it exited cleanly
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, "cleaned up\n", string(out))
+}
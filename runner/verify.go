@@ -0,0 +1,110 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/ericsuh/adapt/aptfile"
+	"github.com/ericsuh/adapt/armor"
+	"github.com/ericsuh/adapt/download"
+	"github.com/ericsuh/adapt/pgp"
+)
+
+// Check that the repository's release file is signed by one of the keys
+// in keyring, so that a wrong signed-by key is caught before apt-get
+// update. InRelease is preferred, falling back to Release and Release.gpg
+// for repositories that only publish a detached signature. Keys and
+// signatures that use algorithms or versions the pgp package can't check
+// are left for apt to check, with a warning.
+func verifyRepoSignature(ctx context.Context, client *download.Client, d aptfile.RepoDirective, keyringData []byte) error {
+	keyring, err := pgp.ReadKeyring(keyringData)
+	if pgp.IsUnsupported(err) {
+		log.Printf("Warning: can't check the signature of %s against %s (%v), leaving it to apt", d.URL, keySource(d), err)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error reading keyring from %s: %w", keySource(d), err)
+	}
+	base := releaseBaseURL(d)
+	fmt.Printf("Verifying repository signature: %s\n", base)
+
+	var key *pgp.Key
+	inRelease, err := client.Get(ctx, base+"/InRelease")
+	if err == nil {
+		msg, err := armor.ParseCleartext(bytes.NewReader(inRelease))
+		if err != nil {
+			return fmt.Errorf("error parsing %s/InRelease: %w", base, err)
+		}
+		key, err = keyring.VerifyCleartext(msg)
+		if pgp.IsUnsupported(err) {
+			log.Printf("Warning: can't check the signature of %s (%v), leaving it to apt", d.URL, err)
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("repository %s does not match key %s: %w", d.URL, keySource(d), err)
+		}
+	} else if isMissing(err) {
+		release, err := client.Get(ctx, base+"/Release")
+		if err != nil {
+			return err
+		}
+		sig, err := client.Get(ctx, base+"/Release.gpg")
+		if err != nil {
+			return err
+		}
+		if bytes.HasPrefix(bytes.TrimSpace(sig), []byte("-----BEGIN")) {
+			block, err := armor.Parse(bytes.NewReader(sig))
+			if err != nil {
+				return fmt.Errorf("error parsing %s/Release.gpg: %w", base, err)
+			}
+			sig = block.Body
+		}
+		key, err = keyring.VerifyDetached(release, sig)
+		if pgp.IsUnsupported(err) {
+			log.Printf("Warning: can't check the signature of %s (%v), leaving it to apt", d.URL, err)
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("repository %s does not match key %s: %w", d.URL, keySource(d), err)
+		}
+	} else {
+		return err
+	}
+	if key.UserID != "" {
+		fmt.Printf("Repository signed by key %s (%s)\n", key.KeyIDString(), key.UserID)
+	} else {
+		fmt.Printf("Repository signed by key %s\n", key.KeyIDString())
+	}
+	return nil
+}
+
+// Whether an InRelease download failed because there isn't one. Besides
+// 404, S3 and CloudFront answer 403 for missing objects.
+func isMissing(err error) bool {
+	var statusErr *download.StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	switch statusErr.StatusCode {
+	case http.StatusNotFound, http.StatusForbidden, http.StatusGone:
+		return true
+	}
+	return false
+}
+
+// The URL of the directory holding the Release files. Flat repositories
+// have a suite ending in "/" and no component, and keep them there
+// directly instead of under dists/.
+func releaseBaseURL(d aptfile.RepoDirective) string {
+	url := strings.TrimSuffix(d.URL, "/")
+	if d.Component == "" && strings.HasSuffix(d.Suite, "/") {
+		suite := strings.Trim(d.Suite, "/")
+		if suite == "" || suite == "." {
+			return url
+		}
+		return fmt.Sprintf("%s/%s", url, suite)
+	}
+	return fmt.Sprintf("%s/dists/%s", url, d.Suite)
+}
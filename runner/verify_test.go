@@ -0,0 +1,173 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ericsuh/adapt/aptfile"
+	"github.com/ericsuh/adapt/armor"
+	"github.com/stretchr/testify/require"
+)
+
+func readTestKeyring(t *testing.T, name string) []byte {
+	t.Helper()
+	content, err := os.ReadFile(filepath.Join("..", "test_data", name))
+	require.NoError(t, err)
+	keyring, err := dearmorKeyring(bytes.NewReader(content))
+	require.NoError(t, err)
+	return keyring
+}
+
+func TestVerifyRepoSignature(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir(filepath.Join("..", "test_data", "repos"))))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		repo    string
+		keyFile string
+		wantErr string
+	}{
+		{name: "ed25519 InRelease", repo: "alice", keyFile: "alice_cert.asc"},
+		{name: "rsa InRelease", repo: "bob", keyFile: "bob_cert.asc"},
+		{name: "detached Release.gpg", repo: "detached", keyFile: "bob_cert.asc"},
+		{name: "wrong key", repo: "bob", keyFile: "alice_cert.asc", wantErr: "FBFCC82A015E7330"},
+		{name: "missing repo", repo: "nonexistent", keyFile: "alice_cert.asc", wantErr: "404 Not Found"},
+		// ECDSA can't be checked here, so it's left to apt
+		{name: "unsupported algorithm", repo: "carol", keyFile: "carol_cert.asc"},
+		{name: "unsupported key for another signer", repo: "bob", keyFile: "carol_cert.asc", wantErr: "FBFCC82A015E7330"},
+		{name: "key for unsupported signer", repo: "carol", keyFile: "bob_cert.asc", wantErr: "does not match key"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := aptfile.RepoDirective{
+				URL:       server.URL + "/" + tc.repo,
+				Suite:     "stable",
+				Component: "main",
+				SignedBy:  tc.keyFile,
+			}
+			err := verifyRepoSignature(context.Background(), testDownloader(server), d, readTestKeyring(t, tc.keyFile))
+			if tc.wantErr != "" {
+				require.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestVerifyRepoSignatureDescribesKey(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir(filepath.Join("..", "test_data", "repos"))))
+	defer server.Close()
+	aliceCert, err := os.ReadFile(filepath.Join("..", "test_data", "alice_cert.asc"))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		dir     aptfile.RepoDirective
+		wantErr string
+	}{
+		{
+			name:    "inline key",
+			dir:     aptfile.RepoDirective{SignedBy: string(aliceCert)},
+			wantErr: "does not match key inline key:",
+		},
+		{
+			name:    "keyserver",
+			dir:     aptfile.RepoDirective{Keyserver: "hkps://keyserver.ubuntu.com", Fingerprint: aliceFingerprint},
+			wantErr: "does not match key hkps://keyserver.ubuntu.com (fingerprint " + aliceFingerprint + "):",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := tc.dir
+			d.URL, d.Suite, d.Component = server.URL+"/bob", "stable", "main"
+			err := verifyRepoSignature(context.Background(), testDownloader(server), d, readTestKeyring(t, "alice_cert.asc"))
+			require.ErrorContains(t, err, tc.wantErr)
+			require.NotContains(t, err.Error(), "BEGIN PGP")
+		})
+	}
+}
+
+func TestVerifyRepoSignatureArmoredDetached(t *testing.T) {
+	dir := filepath.Join("..", "test_data", "repos", "detached", "dists", "stable")
+	release, err := os.ReadFile(filepath.Join(dir, "Release"))
+	require.NoError(t, err)
+	sig, err := os.ReadFile(filepath.Join(dir, "Release.gpg"))
+	require.NoError(t, err)
+	var armored bytes.Buffer
+	require.NoError(t, armor.Encode(&armored, armor.BLOCK_TYPE_SIGNATURE, nil, sig))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dists/stable/Release", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(release)
+	})
+	mux.HandleFunc("/dists/stable/Release.gpg", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(armored.Bytes())
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	d := aptfile.RepoDirective{URL: server.URL, Suite: "stable", Component: "main", SignedBy: "bob"}
+	require.NoError(t, verifyRepoSignature(context.Background(), testDownloader(server), d, readTestKeyring(t, "bob_cert.asc")))
+}
+
+func TestVerifyRepoSignatureWithoutInRelease(t *testing.T) {
+	dir := filepath.Join("..", "test_data", "repos", "detached", "dists", "stable")
+	for _, status := range []int{http.StatusNotFound, http.StatusForbidden, http.StatusGone, http.StatusUnauthorized} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/dists/stable/InRelease", func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, http.StatusText(status), status)
+			})
+			mux.Handle("/dists/stable/", http.StripPrefix("/dists/stable/", http.FileServer(http.Dir(dir))))
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			d := aptfile.RepoDirective{URL: server.URL, Suite: "stable", Component: "main", SignedBy: "bob"}
+			err := verifyRepoSignature(context.Background(), testDownloader(server), d, readTestKeyring(t, "bob_cert.asc"))
+			if status == http.StatusUnauthorized {
+				// Not a missing file, so no falling back
+				require.ErrorContains(t, err, "401 Unauthorized")
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestReleaseBaseURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		dir      aptfile.RepoDirective
+		expected string
+	}{
+		{
+			name:     "standard repo",
+			dir:      aptfile.RepoDirective{URL: "https://example.com/ubuntu/", Suite: "noble", Component: "main"},
+			expected: "https://example.com/ubuntu/dists/noble",
+		},
+		{
+			name:     "flat repo",
+			dir:      aptfile.RepoDirective{URL: "https://example.com/repo", Suite: "stable/"},
+			expected: "https://example.com/repo/stable",
+		},
+		{
+			name:     "flat repo at root",
+			dir:      aptfile.RepoDirective{URL: "https://example.com/repo", Suite: "./"},
+			expected: "https://example.com/repo",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, releaseBaseURL(tc.dir))
+		})
+	}
+}